@@ -0,0 +1,424 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// actorBatch messages processed by an actor before it yields worker to other actors
+const actorBatch = 64
+
+// ErrActorStopped actor stopped by supervisor before message processed
+var ErrActorStopped = errors.New("actor stopped")
+
+// Actor entity with state only accessed by its own messages, e.g. a guild or a room.
+// messages of an actor are processed one by one on the worker owns the actor, so no lock is needed.
+type Actor interface {
+	// Receive process message, returned value is the reply of Ask, ignored by Tell
+	Receive(ctx context.Context, msg interface{}) (interface{}, error)
+}
+
+// ActorStarter optional, OnStart called before the first message of activated actor, e.g. load state
+type ActorStarter interface {
+	OnStart(ctx context.Context) error
+}
+
+// ActorStopper optional, OnStop called when actor passivated or system stopped, e.g. save state
+type ActorStopper interface {
+	OnStop(ctx context.Context)
+}
+
+// ActorFactory create actor of entity id
+type ActorFactory func(id string) Actor
+
+// ActorSystemOption option of NewActorSystem
+type ActorSystemOption func(s *ActorSystem)
+
+// WithActorWorkers workers actors run on, actor is bound to a worker by hash of its id. default is 16
+func WithActorWorkers(n int) ActorSystemOption {
+	return func(s *ActorSystem) {
+		s.workerSize = max(n, 1)
+	}
+}
+
+// WithPassivateAfter actor without messages for idle is stopped to free memory, activated again by next message.
+// <= 0 disables passivation. default is 10 minutes
+func WithPassivateAfter(idle time.Duration) ActorSystemOption {
+	return func(s *ActorSystem) {
+		s.idle = idle
+	}
+}
+
+// WithSupervisor actor panicked is restarted with a new instance, it is stopped if restarted more than maxRestarts within duration.
+// default is 3 restarts within 1 minute
+func WithSupervisor(maxRestarts int, within time.Duration) ActorSystemOption {
+	return func(s *ActorSystem) {
+		s.maxRestarts, s.within = maxRestarts, within
+	}
+}
+
+// ActorSystem registry of actors, actors are activated by the first message sent to them
+type ActorSystem struct {
+	name        string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	workerSize  int
+	workers     []Worker
+	idle        time.Duration
+	maxRestarts int
+	within      time.Duration
+	lock        sync.Mutex
+	factories   map[string]ActorFactory // key=kind
+	cells       map[actorKey]*actorCell // active actors
+}
+
+type actorKey struct {
+	kind string
+	id   string
+}
+
+// NewActorSystem create actor system
+func NewActorSystem(name string, opts ...ActorSystemOption) *ActorSystem {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &ActorSystem{
+		name:        name,
+		ctx:         ctx,
+		cancel:      cancel,
+		workerSize:  16,
+		idle:        10 * time.Minute,
+		maxRestarts: 3,
+		within:      time.Minute,
+		factories:   map[string]ActorFactory{},
+		cells:       map[actorKey]*actorCell{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for idx := 0; idx < s.workerSize; idx++ {
+		s.workers = append(s.workers, NewSingleWorker(fmt.Sprintf("%s-actor-%d", name, idx), func(ctx context.Context, i interface{}) {
+			logk.Error("actor worker panic occurred", zap.String("system", name), zap.Any("err", i))
+		}))
+	}
+	if s.idle > 0 {
+		go s.passivateLoop()
+	}
+	return s
+}
+
+// Register factory of actor kind
+func (s *ActorSystem) Register(kind string, factory ActorFactory) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.factories[kind] = factory
+}
+
+// ActorOf reference of actor, actor is activated when message sent to it
+func (s *ActorSystem) ActorOf(kind, id string) *ActorRef {
+	return &ActorRef{system: s, key: actorKey{kind: kind, id: id}}
+}
+
+// ActorCount active actors
+func (s *ActorSystem) ActorCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.cells)
+}
+
+// Stop stop all actors, OnStop of actors are called on their workers. returns when all stopped or ctx done
+func (s *ActorSystem) Stop(ctx context.Context) error {
+	s.cancel()
+	s.lock.Lock()
+	cells := make([]*actorCell, 0, len(s.cells))
+	for _, cell := range s.cells {
+		cells = append(cells, cell)
+	}
+	s.lock.Unlock()
+	for _, cell := range cells {
+		cell.enqueue(envelope{passivate: true, force: true})
+	}
+	for _, cell := range cells {
+		select {
+		case <-cell.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// cell returns active cell of actor, activate it if absent
+func (s *ActorSystem) cell(key actorKey) (*actorCell, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ctx.Err() != nil {
+		return nil, errors.Errorf("actor system [%s] stopped", s.name)
+	}
+	if cell, ok := s.cells[key]; ok {
+		return cell, nil
+	}
+	factory, ok := s.factories[key.kind]
+	if !ok {
+		return nil, errors.Errorf("actor kind [%s] not registered", key.kind)
+	}
+	cell := &actorCell{
+		system:  s,
+		ref:     &ActorRef{system: s, key: key},
+		factory: factory,
+		worker:  s.workers[hashKey(key.kind+"/"+key.id)%uint64(len(s.workers))],
+		active:  time.Now(),
+		stopped: make(chan struct{}),
+	}
+	s.cells[key] = cell
+	return cell, nil
+}
+
+func (s *ActorSystem) remove(cell *actorCell) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cells[cell.ref.key] == cell {
+		delete(s.cells, cell.ref.key)
+	}
+}
+
+// passivateLoop ask idle actors to passivate
+func (s *ActorSystem) passivateLoop() {
+	ticker := time.NewTicker(max(s.idle/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			for _, cell := range s.cells {
+				if cell.idleFor() > s.idle {
+					cell.enqueue(envelope{passivate: true})
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// ActorRef reference of actor, valid across passivation and restart of actor
+type ActorRef struct {
+	system *ActorSystem
+	key    actorKey
+}
+
+// Kind of actor
+func (ref *ActorRef) Kind() string {
+	return ref.key.kind
+}
+
+// Id entity id of actor
+func (ref *ActorRef) Id() string {
+	return ref.key.id
+}
+
+// Tell send msg to actor without waiting
+func (ref *ActorRef) Tell(msg interface{}) error {
+	return ref.send(envelope{ctx: context.Background(), msg: msg})
+}
+
+// Ask send msg to actor and wait for reply until ctx done.
+// do not Ask actor running on the same worker from an actor, it dead locks, use Tell instead.
+func (ref *ActorRef) Ask(ctx context.Context, msg interface{}) (interface{}, error) {
+	reply := make(chan actorReply, 1)
+	if err := ref.send(envelope{ctx: ctx, msg: msg, reply: reply}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-reply:
+		return r.value, r.err
+	}
+}
+
+func (ref *ActorRef) send(env envelope) error {
+	for {
+		cell, err := ref.system.cell(ref.key)
+		if err != nil {
+			return err
+		}
+		// cell may be stopped after got, get the new one
+		if cell.enqueue(env) {
+			return nil
+		}
+	}
+}
+
+// ActorOfCtx returns the actor receiving message in Actor.Receive
+func ActorOfCtx(ctx context.Context) *ActorRef {
+	ref, _ := ctx.Value(CtxKeyActor).(*ActorRef)
+	return ref
+}
+
+type envelope struct {
+	ctx       context.Context
+	msg       interface{}
+	reply     chan actorReply
+	passivate bool
+	force     bool // passivate even if mailbox is not empty
+}
+
+type actorReply struct {
+	value interface{}
+	err   error
+}
+
+// actorCell activation of actor
+type actorCell struct {
+	system    *ActorSystem
+	ref       *ActorRef
+	factory   ActorFactory
+	worker    Worker
+	lock      sync.Mutex
+	mailbox   []envelope
+	scheduled bool
+	closed    bool
+	active    time.Time
+	stopped   chan struct{}
+	// accessed on worker only
+	actor    Actor
+	restarts []time.Time
+}
+
+// enqueue returns false if cell stopped
+func (c *actorCell) enqueue(env envelope) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	c.mailbox = append(c.mailbox, env)
+	if !env.passivate {
+		c.active = time.Now()
+	}
+	if !c.scheduled {
+		c.scheduled = true
+		c.worker.Run(c.system.ctx, c.drain)
+	}
+	return true
+}
+
+func (c *actorCell) idleFor() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Since(c.active)
+}
+
+// drain process messages in mailbox on worker
+func (c *actorCell) drain() {
+	for i := 0; i < actorBatch; i++ {
+		c.lock.Lock()
+		if len(c.mailbox) == 0 {
+			c.scheduled = false
+			c.lock.Unlock()
+			return
+		}
+		env := c.mailbox[0]
+		c.mailbox = c.mailbox[1:]
+		if env.passivate && (env.force || len(c.mailbox) == 0 && time.Since(c.active) > c.system.idle) {
+			c.closeLocked(ErrActorStopped)
+			c.lock.Unlock()
+			c.stop()
+			return
+		}
+		c.lock.Unlock()
+		if !env.passivate {
+			c.process(env)
+		}
+	}
+	// yield worker to other actors
+	c.worker.Run(c.system.ctx, c.drain)
+}
+
+func (c *actorCell) process(env envelope) {
+	if c.actor == nil {
+		if err := c.start(); err != nil {
+			c.reply(env, nil, err)
+			return
+		}
+	}
+	var value interface{}
+	var err error
+	panicked := func() (panicked bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				logk.Error("actor panic occurred", zap.String("kind", c.ref.key.kind), zap.String("id", c.ref.key.id),
+					zap.Any("err", r), zap.ByteString("stack", debug.Stack()))
+				err, panicked = errors.Errorf("actor panic: %v", r), true
+			}
+		}()
+		value, err = c.actor.Receive(context.WithValue(env.ctx, CtxKeyActor, c.ref), env.msg)
+		return false
+	}()
+	c.reply(env, value, err)
+	if panicked {
+		c.restart()
+	}
+}
+
+func (c *actorCell) start() error {
+	actor := c.factory(c.ref.key.id)
+	if starter, ok := actor.(ActorStarter); ok {
+		if err := starter.OnStart(context.WithValue(c.system.ctx, CtxKeyActor, c.ref)); err != nil {
+			return errors.WithMessage(err, "start actor")
+		}
+	}
+	c.actor = actor
+	return nil
+}
+
+// restart discard panicked instance, next message is processed by a new one.
+// actor is stopped if restarted too many times
+func (c *actorCell) restart() {
+	now := time.Now()
+	restarts := c.restarts[:0]
+	for _, ts := range c.restarts {
+		if now.Sub(ts) < c.system.within {
+			restarts = append(restarts, ts)
+		}
+	}
+	c.restarts, c.actor = append(restarts, now), nil
+	if len(c.restarts) > c.system.maxRestarts {
+		logk.Error("actor restarted too many times, stop it", zap.String("kind", c.ref.key.kind), zap.String("id", c.ref.key.id),
+			zap.Int("restarts", len(c.restarts)))
+		c.lock.Lock()
+		c.closeLocked(ErrActorStopped)
+		c.lock.Unlock()
+		c.stop()
+	}
+}
+
+// closeLocked reject messages left in mailbox, new messages are sent to the next activation
+func (c *actorCell) closeLocked(err error) {
+	c.closed = true
+	for _, env := range c.mailbox {
+		c.reply(env, nil, err)
+	}
+	c.mailbox = nil
+}
+
+func (c *actorCell) stop() {
+	if stopper, ok := c.actor.(ActorStopper); ok {
+		stopper.OnStop(context.WithValue(context.Background(), CtxKeyActor, c.ref))
+	}
+	c.actor = nil
+	c.system.remove(c)
+	close(c.stopped)
+}
+
+func (c *actorCell) reply(env envelope, value interface{}, err error) {
+	if env.reply != nil {
+		env.reply <- actorReply{value: value, err: err}
+	}
+}
@@ -0,0 +1,86 @@
+package smart
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type counterActor struct {
+	id      string
+	count   int
+	store   *sync.Map // saved counts, key=id
+	stopped *int32
+}
+
+func (a *counterActor) OnStart(ctx context.Context) error {
+	if v, ok := a.store.Load(a.id); ok {
+		a.count = v.(int)
+	}
+	return nil
+}
+
+func (a *counterActor) OnStop(ctx context.Context) {
+	a.store.Store(a.id, a.count)
+	atomic.AddInt32(a.stopped, 1)
+}
+
+func (a *counterActor) Receive(ctx context.Context, msg interface{}) (interface{}, error) {
+	switch msg {
+	case "incr":
+		a.count++ // no lock
+	case "panic":
+		panic("boom")
+	}
+	return a.count, nil
+}
+
+func TestActor(t *testing.T) {
+	store, stopped := &sync.Map{}, int32(0)
+	s := NewActorSystem("test", WithActorWorkers(4), WithPassivateAfter(50*time.Millisecond), WithSupervisor(2, time.Minute))
+	s.Register("counter", func(id string) Actor {
+		return &counterActor{id: id, store: store, stopped: &stopped}
+	})
+	ctx := context.Background()
+	ref := s.ActorOf("counter", "guild-1")
+	// serialized
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Nil(t, ref.Tell("incr"))
+			}
+		}()
+	}
+	wg.Wait()
+	count, err := ref.Ask(ctx, "get")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, count)
+	// passivated, then activated with saved state
+	assert.Eventually(t, func() bool { return s.ActorCount() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stopped))
+	count, _ = ref.Ask(ctx, "incr")
+	assert.Equal(t, 1001, count)
+	// restarted after panic, state of panicked instance is discarded
+	_, err = ref.Ask(ctx, "panic")
+	assert.NotNil(t, err)
+	count, _ = ref.Ask(ctx, "get")
+	assert.Equal(t, 1000, count)
+	// stopped when restarted too many times
+	_, _ = ref.Ask(ctx, "panic")
+	_, _ = ref.Ask(ctx, "panic")
+	assert.Eventually(t, func() bool { return s.ActorCount() == 0 }, time.Second, 10*time.Millisecond)
+	// unknown kind
+	_, err = s.ActorOf("room", "1").Ask(ctx, "get")
+	assert.NotNil(t, err)
+	// stop
+	_ = ref.Tell("incr")
+	assert.Nil(t, s.Stop(ctx))
+	assert.Equal(t, 0, s.ActorCount())
+	assert.NotNil(t, ref.Tell("incr"))
+}
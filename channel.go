@@ -10,6 +10,8 @@ import (
 	"gitee.com/ywengineer/smart/pkg"
 	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Channel interface {
@@ -20,6 +22,10 @@ type Channel interface {
 	GetFd() int
 	SetAttachment(attachment interface{})
 	GetAttachment() interface{}
+	// Schedule run task on worker of channel after delay, canceled when channel closed
+	Schedule(delay time.Duration, task func()) *Timer
+	// ScheduleAtFixedRate run task on worker of channel after delay then every period, canceled when channel closed
+	ScheduleAtFixedRate(delay, period time.Duration, task func()) *Timer
 }
 
 type defaultChannel struct {
@@ -32,7 +38,15 @@ type defaultChannel struct {
 	handlers     []ChannelHandler
 	interceptors []MessageInterceptor
 	msgHandlers  []MessageHandler
+	router       *handlerManager
+	workers      WorkerManager // workers of server, invocations with dispatch key run on them
 	attachment   interface{}
+	sendLock     sync.Mutex // channel may be shared by workers, e.g. backend link of gate
+	workerLock   sync.Mutex // guards moving channel between workers against tasks queued, see rebalance
+	inflight     int32      // tasks queued on worker of channel
+	refs         int32      // tasks of channel running on other workers, channel is pooled after they finished
+	panics       int32      // panics of handlers caused by channel
+	timers       atomic.Pointer[channelTimers]
 }
 
 func (h *defaultChannel) SetAttachment(attachment interface{}) {
@@ -63,7 +77,43 @@ func (h *defaultChannel) Send(msg interface{}) error {
 
 // LaterRun run task in worker related SocketChannel
 func (h *defaultChannel) LaterRun(task func()) {
-	h.worker.Run(h.ctx, task)
+	h.queue().Run(h.ctx, func() {
+		defer atomic.AddInt32(&h.inflight, -1)
+		task()
+	})
+}
+
+// queue count task to be queued on worker of channel and returns the worker, the task must decrease inflight
+func (h *defaultChannel) queue() Worker {
+	h.workerLock.Lock()
+	defer h.workerLock.Unlock()
+	atomic.AddInt32(&h.inflight, 1)
+	return h.worker
+}
+
+// rebalance move channel to worker chosen by balancer of server when no task of channel is queued,
+// so tasks of channel keep ordered. tasks queued by other goroutines, e.g. timers, wait for the move.
+func (h *defaultChannel) rebalance() {
+	if h.workers == nil {
+		return
+	}
+	h.workerLock.Lock()
+	defer h.workerLock.Unlock()
+	if atomic.LoadInt32(&h.inflight) == 0 {
+		h.worker = h.workers.Rebalance(h.fd, h.worker)
+	}
+}
+
+// retain keep channel out of pool until release, e.g. invocation dispatched to other worker
+func (h *defaultChannel) retain() {
+	atomic.AddInt32(&h.refs, 1)
+}
+
+// release drop reference taken by retain, the last one of closed channel puts it back to pool
+func (h *defaultChannel) release() {
+	if atomic.AddInt32(&h.refs, -1) < 0 {
+		channelPool.Put(h)
+	}
 }
 
 func (h *defaultChannel) Close() error {
@@ -74,6 +124,8 @@ func (h *defaultChannel) send(data []byte) error {
 	if h.conn == nil {
 		return errors.New("SocketChannel is not initialized correctly")
 	}
+	h.sendLock.Lock()
+	defer h.sendLock.Unlock()
 	writer := h.conn.Writer()
 	defer writer.Flush()
 	if _, err := writer.WriteBinary(data); err != nil {
@@ -99,9 +151,12 @@ func (h *defaultChannel) onOpen() {
 }
 
 func (h *defaultChannel) onClose() {
+	if ct := h.timers.Load(); ct != nil {
+		ct.close()
+	}
 	if len(h.handlers) > 0 {
 		h.LaterRun(func() {
-			defer channelPool.Put(h)
+			defer h.release() // reference of conn
 			for _, handler := range h.handlers {
 				handler.OnClose(h)
 			}
@@ -109,6 +164,49 @@ func (h *defaultChannel) onClose() {
 	}
 }
 
+// discard input of channel, e.g. server is stopping
+func (h *defaultChannel) discard() {
+	reader := h.conn.Reader()
+	if n := reader.Len(); n > 0 {
+		_ = reader.Skip(n)
+	}
+	_ = reader.Release()
+}
+
+// runMessage run task of msg on worker of channel, overflow of worker queue is handled by policy of server.
+// returns error if channel is closed by the policy
+func (h *defaultChannel) runMessage(msg *message.ProtocolMessage, task func()) error {
+	if h.workers == nil {
+		h.LaterRun(task)
+		return nil
+	}
+	err := h.queue().TryRun(h.ctx, func() {
+		defer atomic.AddInt32(&h.inflight, -1)
+		task()
+	})
+	if err == nil {
+		return nil
+	}
+	atomic.AddInt32(&h.inflight, -1)
+	defer protocolMessagePool.Put(msg)
+	return h.onOverflow(msg)
+}
+
+// onOverflow apply overflow policy of workers to msg rejected by full queue, returns ErrWorkerQueueFull if channel closed
+func (h *defaultChannel) onOverflow(msg *message.ProtocolMessage) error {
+	switch h.workers.Overflow() {
+	case OverflowDrop:
+		logk.Debug("worker queue is full, drop message", zap.Int("channel", h.fd), zap.Int32("route", msg.GetRoute()))
+	case OverflowClose:
+		logk.Warn("worker queue is full, close channel", zap.Int("channel", h.fd), zap.Int32("route", msg.GetRoute()))
+		_ = h.Close()
+		return ErrWorkerQueueFull
+	default:
+		_ = SendError(h, msg, NewError(ErrCodeServiceUnavailable, "server busy"))
+	}
+	return nil
+}
+
 func (h *defaultChannel) onMessageRead() error {
 	for {
 		msg := protocolMessagePool.Get()
@@ -121,7 +219,8 @@ func (h *defaultChannel) onMessageRead() error {
 		} else if errors.Is(err, codec.ErrPkgNotFull) { // pkg not full, skip
 			return nil
 		} else { // decode success
-			h.LaterRun(func(msg *message.ProtocolMessage) func() {
+			h.rebalance()
+			if err = h.runMessage(msg.(*message.ProtocolMessage), func(msg *message.ProtocolMessage) func() {
 				return func() {
 					defer protocolMessagePool.Put(msg)
 					//
@@ -152,7 +251,9 @@ func (h *defaultChannel) onMessageRead() error {
 						}
 					}
 				}
-			}(msg.(*message.ProtocolMessage)))
+			}(msg.(*message.ProtocolMessage))); err != nil {
+				return err
+			}
 		} //
 	}
 }
@@ -2,10 +2,13 @@ package smart
 
 import (
 	"context"
+	"crypto/tls"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart/pkg"
 	"github.com/cloudwego/netpoll"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"net"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -18,28 +21,43 @@ func NewAutoCloseSmartClient(ctx context.Context, network, addr string, initiali
 }
 
 func NewSmartClient(ctx context.Context, network, addr string, initializers []ChannelInitializer, autoClose bool) Channel {
+	channel, err := DialSmartClient(ctx, network, addr, initializers, autoClose)
+	if err != nil {
+		logk.Fatal("connect to smart server failed", zap.String("server", network+"://"+addr), zap.Error(err))
+		return nil
+	}
+	return channel
+}
+
+// DialService connect to a healthy instance of service found by discovery, instance with higher weight is preferred.
+// other instances are tried when connect failed
+func DialService(ctx context.Context, d Discovery, service string, initializers []ChannelInitializer, autoClose bool) (Channel, error) {
+	instances, err := d.Instances(service)
+	if err != nil {
+		return nil, errors.WithMessage(err, "discover service: "+service)
+	}
+	err = errors.Errorf("no healthy instance of service [%s]", service)
+	for _, ins := range shuffleByWeight(healthyInstances(instances)) {
+		var channel Channel
+		if channel, err = DialSmartClient(ctx, ins.network(), ins.Address, initializers, autoClose); err == nil {
+			return channel, nil
+		}
+		logk.Warn("connect to service instance failed", zap.String("service", service), zap.String("instance", ins.Address), zap.Error(err))
+	}
+	return nil, err
+}
+
+// DialSmartClient connect to smart server, returns error instead of exit when failed
+func DialSmartClient(ctx context.Context, network, addr string, initializers []ChannelInitializer, autoClose bool) (Channel, error) {
 	//
 	dialer := netpoll.NewDialer()
 	//
 	conn, err := dialer.DialConnection(network, addr, time.Second)
 	//
 	if err != nil {
-		logk.Fatal("connect to smart server failed", zap.String("server", network+"://"+addr), zap.Error(err))
-		return nil
-	}
-	//------------------------------------------------------------------------------------
-	scId := strconv.FormatUint(atomic.AddUint64(&seqSmartClient, 1), 10)
-	channel := &defaultChannel{
-		ctx:  context.WithValue(ctx, CtxKeyFromClient, conn.(netpoll.Conn).Fd()),
-		fd:   conn.(netpoll.Conn).Fd(),
-		conn: pkg.NetNetpollConn(conn),
-		worker: NewSingleWorker("smart-client-"+scId, func(ctx context.Context, i interface{}) {
-			logk.Error("client worker panic occurred", zap.String("smart-client", scId), zap.Any("err", i))
-		}),
-	}
-	for _, initializer := range initializers {
-		initializer(channel)
+		return nil, err
 	}
+	channel := newClientChannel(ctx, pkg.NetNetpollConn(conn), initializers, autoClose)
 	//------------------------------------------------------------------------------------
 	_ = conn.SetOnRequest(func(ctx context.Context, connection netpoll.Connection) error {
 		return channel.onMessageRead()
@@ -50,25 +68,60 @@ func NewSmartClient(ctx context.Context, network, addr string, initializers []Ch
 	})
 	//------------------------------------------------------------------------------------
 	channel.onOpen()
+	return channel, nil
+}
+
+// DialSmartClientTLS connect to smart server over tls, see TLSConfig.ClientConfig
+func DialSmartClientTLS(ctx context.Context, network, addr string, conf *tls.Config, initializers []ChannelInitializer, autoClose bool) (Channel, error) {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: time.Second}, Config: conf}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := pkg.NetTLSConn(conn.(*tls.Conn))
+	channel := newClientChannel(ctx, c, initializers, autoClose)
+	channel.onOpen()
+	go func() {
+		for c.Fill() == nil {
+			if err := channel.onMessageRead(); err != nil {
+				logk.Warn("read tls channel error", zap.String("addr", addr), zap.Error(err))
+			}
+		}
+		_ = c.Close()
+		channel.onClose()
+	}()
+	return channel, nil
+}
+
+// dialLink connect link between services, over tls if conf not nil
+func dialLink(ctx context.Context, network, addr string, conf *tls.Config, initializers []ChannelInitializer) (Channel, error) {
+	if conf != nil {
+		return DialSmartClientTLS(ctx, network, addr, conf, initializers, false)
+	}
+	return DialSmartClient(ctx, network, addr, initializers, false)
+}
+
+// newClientChannel channel of client conn with its own worker
+func newClientChannel(ctx context.Context, conn pkg.Conn, initializers []ChannelInitializer, autoClose bool) *defaultChannel {
+	scId := strconv.FormatUint(atomic.AddUint64(&seqSmartClient, 1), 10)
+	channel := &defaultChannel{
+		ctx:  context.WithValue(ctx, CtxKeyFromClient, conn.Fd()),
+		fd:   conn.Fd(),
+		conn: conn,
+		worker: NewSingleWorker("smart-client-"+scId, func(ctx context.Context, i interface{}) {
+			logk.Error("client worker panic occurred", zap.String("smart-client", scId), zap.Any("err", i))
+		}),
+	}
+	for _, initializer := range initializers {
+		initializer(channel)
+	}
 	// 自动关闭
 	if autoClose {
 		go func() {
-		stop:
-			for {
-				select {
-				case <-ctx.Done():
-					logk.Infof("client will be close, because of client running context is finished. fid: %s", scId)
-					break stop
-				default:
-					if ctx.Err() != nil {
-						logk.Infof("client will be close, because of client context error occurred. fid: %s", scId)
-						break stop
-					}
-				}
-			}
+			<-ctx.Done()
+			logk.Infof("client will be close, because of client running context is finished. fid: %s", scId)
 			logk.Infof("client closed: %v", channel.Close())
 		}()
 	}
-	//
 	return channel
 }
@@ -21,7 +21,27 @@ const (
 	CtxKeyToClient    = "to-client"    // value type is int, connection id
 	CtxKeyToService   = "to-service"   // value type is string, service name
 	CtxKeyTO          = "to"
-	HeaderFrom        = CtxKeyFrom // HeaderFrom
+	CtxKeyRoute       = "route"           // value type is int32, route of request
+	CtxKeyEventBus    = "event-bus"       // value type is *EventBus, bus of router which handler belongs to
+	CtxKeyActor       = "actor"           // value type is *ActorRef, actor receiving message
+	HeaderFrom        = CtxKeyFrom        // HeaderFrom
+	HeaderRoute       = "route"           // route of the request which error response belongs to
+	HeaderErrorCode   = "error-code"      // Error.Code of error response
+	HeaderFromClient  = CtxKeyFromClient  // client connection id on gate, stamped by gate when forwarding
+	HeaderToClient    = CtxKeyToClient    // client connection id on gate, stamped by backend on reply
+	HeaderFromService = CtxKeyFromService // service name of sender
+	HeaderToService   = CtxKeyToService   // service name of receiver
+	HeaderUserId      = "user-id"         // user id of client, backend replies it after login to make gate sticky by user
+	HeaderTraceId     = "trace-id"        // trace id of request, propagated to rpc calls
+	HeaderDeadline    = "deadline"        // unix milliseconds deadline of rpc call, applied to context of handler
+	HeaderGateId      = "gate-id"         // id of gate, sent to backend by RouteGateHello
+	HeaderToUsers     = "to-users"        // comma separated user ids of RoutePush
+)
+
+const (
+	RouteError     int32 = -2 // route of error response, payload is json encoded Error
+	RoutePush      int32 = -3 // backend push to users through gate, payload is proto encoded message delivered to clients
+	RouteGateHello int32 = -4 // gate tell backend its id after link established
 )
 
 var TypeSocketChannel = reflect.TypeOf((*Channel)(nil)).Elem()
@@ -29,6 +49,7 @@ var handlerSignatureRegexp = regexp.MustCompile(handlerRegexp)
 var TypeContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 var TypeProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
 var TypeSmartMessage = reflect.TypeOf((*message.ProtocolMessage)(nil))
+var TypeError = reflect.TypeOf((*error)(nil)).Elem()
 
 //var TypeSmartModule = reflect.TypeOf((*Module)(nil)).Elem()
 
@@ -0,0 +1,121 @@
+package smart
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule parsed cron expression of 5 fields: minute hour day-of-month month day-of-week,
+// fields support *, lists(1,15), ranges(1-5) and steps(*/10, 0-30/5). day-of-week is 0-6, 0 is sunday.
+// descriptors @yearly, @monthly, @weekly, @daily and @hourly are supported too.
+// times are in location of schedule, time.Local by default, e.g. "0 5 * * *" is 05:00 of server time every day.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit set of allowed values
+	domAny, dowAny                bool   // field is *
+	loc                           *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// ParseCron parse cron expression in time.Local
+func ParseCron(spec string) (*CronSchedule, error) {
+	return ParseCronIn(spec, time.Local)
+}
+
+// ParseCronIn parse cron expression in location loc
+func ParseCronIn(spec string, loc *time.Location) (*CronSchedule, error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(spec)]; ok {
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron [%s] must have 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]uint64
+	for idx, field := range fields {
+		set, err := parseCronField(field, bounds[idx][0], bounds[idx][1])
+		if err != nil {
+			return nil, errors.WithMessagef(err, "cron [%s]", spec)
+		}
+		sets[idx] = set
+	}
+	return &CronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*", loc: loc,
+	}, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, errors.Errorf("invalid step of [%s]", part)
+			}
+			rng, step = part[:i], s
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("invalid value of [%s]", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("invalid value of [%s]", part)
+				}
+			} else if step > 1 {
+				to = hi // 5/10 means 5-hi/10
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, errors.Errorf("[%s] out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time matches schedule after t, zero time if none in 5 years
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		} else if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		} else if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		} else if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay day-of-month and day-of-week are OR-ed if both restricted, as cron does
+func (c *CronSchedule) matchDay(t time.Time) bool {
+	dom, dow := c.dom&(1<<uint(t.Day())) != 0, c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
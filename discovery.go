@@ -0,0 +1,236 @@
+package smart
+
+import (
+	"bytes"
+	"context"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"github.com/bytedance/sonic"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"math/rand"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Instance instance of service found by Discovery
+type Instance struct {
+	Service  string            `json:"service" yaml:"service"`
+	Network  string            `json:"network" yaml:"network"` // default is tcp
+	Address  string            `json:"address" yaml:"address"`
+	Weight   int               `json:"weight" yaml:"weight"`   // < 1 is treated as 1
+	Healthy  bool              `json:"healthy" yaml:"healthy"` // unhealthy instance is not used by gate and client
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+func (i Instance) network() string {
+	if len(i.Network) == 0 {
+		return "tcp"
+	}
+	return i.Network
+}
+
+// Discovery find instances of services
+type Discovery interface {
+	// Instances returns current instances of service
+	Instances(service string) ([]Instance, error)
+	// Watch call onChange with all instances of service when they changed, the first call is made with current instances.
+	// watching stops when ctx done
+	Watch(ctx context.Context, service string, onChange func(instances []Instance)) error
+}
+
+// healthyInstances filter healthy instances
+func healthyInstances(instances []Instance) []Instance {
+	healthy := make([]Instance, 0, len(instances))
+	for _, ins := range instances {
+		if ins.Healthy {
+			healthy = append(healthy, ins)
+		}
+	}
+	return healthy
+}
+
+// shuffleByWeight order instances randomly, instance with higher weight is more likely to be ahead
+func shuffleByWeight(instances []Instance) []Instance {
+	remain := append([]Instance{}, instances...)
+	ordered := make([]Instance, 0, len(instances))
+	for len(remain) > 0 {
+		total := 0
+		for _, ins := range remain {
+			total += max(ins.Weight, 1)
+		}
+		n, idx := rand.Intn(total), 0
+		for ; n >= max(remain[idx].Weight, 1); idx++ {
+			n -= max(remain[idx].Weight, 1)
+		}
+		ordered = append(ordered, remain[idx])
+		remain = append(remain[:idx], remain[idx+1:]...)
+	}
+	return ordered
+}
+
+// StaticDiscovery discovery with instances declared in code, instances can be updated at runtime by Update
+type StaticDiscovery struct {
+	lock      sync.RWMutex
+	instances map[string][]Instance // key=service
+	watchers  map[string]map[uint64]func(instances []Instance)
+	seq       uint64
+}
+
+// NewStaticDiscovery create discovery of instances, Instance.Service is required
+func NewStaticDiscovery(instances ...Instance) *StaticDiscovery {
+	sd := &StaticDiscovery{instances: map[string][]Instance{}, watchers: map[string]map[uint64]func(instances []Instance){}}
+	for _, ins := range instances {
+		sd.instances[ins.Service] = append(sd.instances[ins.Service], ins)
+	}
+	return sd
+}
+
+func (sd *StaticDiscovery) Instances(service string) ([]Instance, error) {
+	sd.lock.RLock()
+	defer sd.lock.RUnlock()
+	return append([]Instance{}, sd.instances[service]...), nil
+}
+
+func (sd *StaticDiscovery) Watch(ctx context.Context, service string, onChange func(instances []Instance)) error {
+	sd.lock.Lock()
+	sd.seq++
+	id := sd.seq
+	if sd.watchers[service] == nil {
+		sd.watchers[service] = map[uint64]func(instances []Instance){}
+	}
+	sd.watchers[service][id] = onChange
+	instances := append([]Instance{}, sd.instances[service]...)
+	sd.lock.Unlock()
+	onChange(instances)
+	go func() {
+		<-ctx.Done()
+		sd.lock.Lock()
+		defer sd.lock.Unlock()
+		delete(sd.watchers[service], id)
+	}()
+	return nil
+}
+
+// Update replace instances of service, watchers are notified if instances changed
+func (sd *StaticDiscovery) Update(service string, instances []Instance) {
+	sd.lock.Lock()
+	if old := sd.instances[service]; len(old) == 0 && len(instances) == 0 || reflect.DeepEqual(old, instances) {
+		sd.lock.Unlock()
+		return
+	}
+	if len(instances) == 0 {
+		delete(sd.instances, service)
+	} else {
+		sd.instances[service] = append([]Instance{}, instances...)
+	}
+	watchers := make([]func(instances []Instance), 0, len(sd.watchers[service]))
+	for _, w := range sd.watchers[service] {
+		watchers = append(watchers, w)
+	}
+	sd.lock.Unlock()
+	for _, w := range watchers {
+		w(append([]Instance{}, instances...))
+	}
+}
+
+// fileInstance instance declared in file, healthy by default
+type fileInstance struct {
+	Network  string            `json:"network" yaml:"network"`
+	Address  string            `json:"address" yaml:"address"`
+	Weight   int               `json:"weight" yaml:"weight"`
+	Healthy  *bool             `json:"healthy" yaml:"healthy"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// NewFileDiscovery discovery of instances declared in file, file is reloaded when modified.
+// key of file is service name, value is instances of service, e.g.
+//
+//	{"game": [{"address": "10.0.0.1:12345", "weight": 2}, {"address": "10.0.0.2:12345"}]}
+//
+// unmarshal decodes file, default is json. file is checked every interval until ctx done.
+func NewFileDiscovery(ctx context.Context, file string, interval time.Duration, unmarshal func(data []byte, v interface{}) error) (Discovery, error) {
+	if unmarshal == nil {
+		unmarshal = sonic.Unmarshal
+	}
+	fd := &fileDiscovery{StaticDiscovery: NewStaticDiscovery(), file: file, unmarshal: unmarshal}
+	if err := fd.load(); err != nil {
+		return nil, err
+	}
+	go fd.watch(ctx, interval)
+	return fd, nil
+}
+
+type fileDiscovery struct {
+	*StaticDiscovery
+	file      string
+	unmarshal func(data []byte, v interface{}) error
+	modified  time.Time
+	data      []byte
+}
+
+func (fd *fileDiscovery) load() error {
+	stat, err := os.Stat(fd.file)
+	if err != nil {
+		return errors.WithMessage(err, "stat discovery file")
+	}
+	if stat.ModTime().Equal(fd.modified) {
+		return nil
+	}
+	data, err := os.ReadFile(fd.file)
+	if err != nil {
+		return errors.WithMessage(err, "read discovery file")
+	}
+	fd.modified = stat.ModTime()
+	if bytes.Equal(data, fd.data) {
+		return nil
+	}
+	services := map[string][]fileInstance{}
+	if err = fd.unmarshal(data, &services); err != nil {
+		return errors.WithMessage(err, "unmarshal discovery file")
+	}
+	fd.data = data
+	for service, fis := range services {
+		instances := make([]Instance, 0, len(fis))
+		for _, fi := range fis {
+			instances = append(instances, Instance{
+				Service:  service,
+				Network:  fi.Network,
+				Address:  fi.Address,
+				Weight:   fi.Weight,
+				Healthy:  fi.Healthy == nil || *fi.Healthy,
+				Metadata: fi.Metadata,
+			})
+		}
+		fd.Update(service, instances)
+	}
+	// service removed from file
+	fd.lock.RLock()
+	var removed []string
+	for service := range fd.instances {
+		if _, ok := services[service]; !ok {
+			removed = append(removed, service)
+		}
+	}
+	fd.lock.RUnlock()
+	for _, service := range removed {
+		fd.Update(service, nil)
+	}
+	return nil
+}
+
+func (fd *fileDiscovery) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fd.load(); err != nil {
+				logk.Error("reload discovery file failed, keep the old instances", zap.String("file", fd.file), zap.Error(err))
+			}
+		}
+	}
+}
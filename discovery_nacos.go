@@ -0,0 +1,76 @@
+package smart
+
+import (
+	"context"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"math"
+	"net"
+	"strconv"
+)
+
+// NacosNamingClient methods of nacos naming_client.INamingClient used by nacos discovery
+type NacosNamingClient interface {
+	SelectAllInstances(param vo.SelectAllInstancesParam) ([]model.Instance, error)
+	Subscribe(param *vo.SubscribeParam) error
+	Unsubscribe(param *vo.SubscribeParam) error
+}
+
+// NewNacosDiscovery discovery of instances registered to nacos, services are looked up in group(DEFAULT_GROUP if empty).
+// network of instance is read from metadata "network".
+func NewNacosDiscovery(client NacosNamingClient, group string) Discovery {
+	return &nacosDiscovery{client: client, group: group}
+}
+
+type nacosDiscovery struct {
+	client NacosNamingClient
+	group  string
+}
+
+func (nd *nacosDiscovery) Instances(service string) ([]Instance, error) {
+	instances, err := nd.client.SelectAllInstances(vo.SelectAllInstancesParam{ServiceName: service, GroupName: nd.group})
+	if err != nil {
+		return nil, err
+	}
+	return fromNacosInstances(service, instances), nil
+}
+
+func (nd *nacosDiscovery) Watch(ctx context.Context, service string, onChange func(instances []Instance)) error {
+	instances, err := nd.Instances(service)
+	if err != nil {
+		return err
+	}
+	onChange(instances)
+	param := &vo.SubscribeParam{
+		ServiceName: service,
+		GroupName:   nd.group,
+		SubscribeCallback: func(services []model.Instance, err error) {
+			if err == nil {
+				onChange(fromNacosInstances(service, services))
+			}
+		},
+	}
+	if err = nd.client.Subscribe(param); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = nd.client.Unsubscribe(param)
+	}()
+	return nil
+}
+
+func fromNacosInstances(service string, instances []model.Instance) []Instance {
+	res := make([]Instance, 0, len(instances))
+	for _, ins := range instances {
+		res = append(res, Instance{
+			Service:  service,
+			Network:  ins.Metadata["network"],
+			Address:  net.JoinHostPort(ins.Ip, strconv.FormatUint(ins.Port, 10)),
+			Weight:   int(math.Ceil(ins.Weight)),
+			Healthy:  ins.Healthy && ins.Enable,
+			Metadata: ins.Metadata,
+		})
+	}
+	return res
+}
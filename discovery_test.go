@@ -0,0 +1,88 @@
+package smart
+
+import (
+	"context"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "services.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`{"game": [{"address": "10.0.0.1:1"}, {"address": "10.0.0.2:1", "healthy": false}]}`), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := NewFileDiscovery(ctx, file, 10*time.Millisecond, nil)
+	assert.Nil(t, err)
+	instances, _ := d.Instances("game")
+	assert.Len(t, instances, 2)
+	assert.Len(t, healthyInstances(instances), 1)
+	//
+	var lock sync.Mutex
+	var watched [][]Instance
+	assert.Nil(t, d.Watch(ctx, "game", func(instances []Instance) {
+		lock.Lock()
+		defer lock.Unlock()
+		watched = append(watched, instances)
+	}))
+	// modify file
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, os.WriteFile(file, []byte(`{"game": [{"address": "10.0.0.3:1", "weight": 3}]}`), 0644))
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(watched) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "10.0.0.3:1", watched[1][0].Address)
+	assert.Equal(t, 3, watched[1][0].Weight)
+	assert.True(t, watched[1][0].Healthy)
+}
+
+func TestGateDiscover(t *testing.T) {
+	g := NewGate(WithReconnectBackoff(time.Hour, time.Hour))
+	defer g.Close()
+	d := NewStaticDiscovery(Instance{Service: "game", Address: "127.0.0.1:1", Healthy: true}, Instance{Service: "game", Address: "127.0.0.1:2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, g.Discover(ctx, d, "game"))
+	assert.Len(t, g.services["game"].backends, 1)
+	d.Update("game", []Instance{{Service: "game", Address: "127.0.0.1:3", Healthy: true, Weight: 2}})
+	assert.Len(t, g.services["game"].backends, 1)
+	assert.Equal(t, 2, g.services["game"].backends["127.0.0.1:3"].weight)
+}
+
+type mockNacosClient struct {
+	instances []model.Instance
+	callback  func(services []model.Instance, err error)
+}
+
+func (m *mockNacosClient) SelectAllInstances(param vo.SelectAllInstancesParam) ([]model.Instance, error) {
+	return m.instances, nil
+}
+
+func (m *mockNacosClient) Subscribe(param *vo.SubscribeParam) error {
+	m.callback = param.SubscribeCallback
+	return nil
+}
+
+func (m *mockNacosClient) Unsubscribe(param *vo.SubscribeParam) error {
+	return nil
+}
+
+func TestNacosDiscovery(t *testing.T) {
+	client := &mockNacosClient{instances: []model.Instance{{Ip: "10.0.0.1", Port: 8080, Weight: 1.5, Healthy: true, Enable: true, Metadata: map[string]string{"network": "tcp"}}}}
+	d := NewNacosDiscovery(client, "")
+	var watched []Instance
+	assert.Nil(t, d.Watch(context.Background(), "game", func(instances []Instance) {
+		watched = instances
+	}))
+	assert.Equal(t, Instance{Service: "game", Network: "tcp", Address: "10.0.0.1:8080", Weight: 2, Healthy: true, Metadata: map[string]string{"network": "tcp"}}, watched[0])
+	client.callback([]model.Instance{{Ip: "10.0.0.2", Port: 8080, Healthy: true}}, nil)
+	assert.Equal(t, "10.0.0.2:8080", watched[0].Address)
+	assert.False(t, watched[0].Healthy)
+}
@@ -0,0 +1,60 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"gitee.com/ywengineer/smart/message"
+	"reflect"
+)
+
+// DispatchKey returns key of invocation, invocations with the same key run on the same worker of server,
+// e.g. room id, so operations of a room are serialized even players of the room are on different workers.
+// empty key runs invocation on worker of channel.
+type DispatchKey func(ctx context.Context, header map[string]string, in interface{}) string
+
+// WithDispatchKey run invocations of route on worker owns the key
+func WithDispatchKey(route int, key DispatchKey) ModuleOption {
+	return func(opts *moduleOptions) {
+		opts.dispatchKeys[route] = key
+	}
+}
+
+// KeyFromHeader dispatch key is value of header
+func KeyFromHeader(name string) DispatchKey {
+	return func(ctx context.Context, header map[string]string, in interface{}) string {
+		return header[name]
+	}
+}
+
+// KeyFromField dispatch key is value of exported field of request struct, zero value means no key
+func KeyFromField(name string) DispatchKey {
+	return func(ctx context.Context, header map[string]string, in interface{}) string {
+		v := reflect.Indirect(reflect.ValueOf(in))
+		if v.Kind() != reflect.Struct {
+			return ""
+		}
+		if f := v.FieldByName(name); f.IsValid() && !f.IsZero() {
+			return fmt.Sprint(f.Interface())
+		}
+		return ""
+	}
+}
+
+// dispatchWorker worker owns dispatch key of invocation, nil if invocation should run on the current worker
+func (hd *handlerDefinition) dispatchWorker(ctx context.Context, c Channel, req *message.ProtocolMessage, in interface{}) Worker {
+	if hd.dispatch == nil {
+		return nil
+	}
+	dc, ok := c.(*defaultChannel)
+	if !ok || dc.workers == nil {
+		return nil
+	}
+	key := hd.dispatch(ctx, req.GetHeader(), in)
+	if len(key) == 0 {
+		return nil
+	}
+	if w := dc.workers.PickKey(key); w != dc.worker {
+		return w
+	}
+	return nil
+}
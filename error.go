@@ -0,0 +1,96 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/codec"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// error codes used by the engine itself. business error codes should avoid this range.
+const (
+	ErrCodeBadRequest         int32 = 400 // request payload can not be decoded
+	ErrCodeUnauthorized       int32 = 401 // AuthRequired middleware rejected
+	ErrCodeForbidden          int32 = 403 // AdminOnly middleware rejected
+	ErrCodeRouteNotFound      int32 = 404 // no handler registered for the route
+	ErrCodeTimeout            int32 = 408 // handler exceeded its deadline
+	ErrCodeUnsupportedCodec   int32 = 415 // codec of request is not supported
+	ErrCodeInvalidRequest     int32 = 422 // request rejected by validation
+	ErrCodeTooManyRequests    int32 = 429 // RateLimit middleware rejected
+	ErrCodeInternal           int32 = 500 // handler returned an untyped error
+	ErrCodeServiceUnavailable int32 = 503 // gate has no available backend of the service, or worker queue is full
+)
+
+// Error structured error returned by handler, it will be sent to client with route RouteError
+type Error struct {
+	Code    int32  `json:"code" msgpack:"code"`
+	Message string `json:"message" msgpack:"message"`
+}
+
+func NewError(code int32, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+func NewErrorf(code int32, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("smart error: code = %d, message = %s", e.Code, e.Message)
+}
+
+// toSmartError convert any error to *Error. untyped error will be hidden from client.
+func toSmartError(err error) *Error {
+	var se *Error
+	if errors.As(err, &se) {
+		return se
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewError(ErrCodeTimeout, "timeout")
+	}
+	return NewError(ErrCodeInternal, "internal server error")
+}
+
+// newErrorResponse fill res as an error response of request(route, seq).
+// payload of error response is always json, so client can decode it without knowing the request codec.
+func newErrorResponse(res *message.ProtocolMessage, route, seq int32, err error) (*message.ProtocolMessage, error) {
+	se := toSmartError(err)
+	payload, e := codec.Json().Encode(se)
+	if e != nil {
+		return nil, e
+	}
+	if res.Header == nil {
+		res.Header = map[string]string{}
+	}
+	res.Header[HeaderRoute] = strconv.Itoa(int(route))
+	res.Header[HeaderErrorCode] = strconv.Itoa(int(se.Code))
+	res.Seq, res.Route, res.Codec, res.Payload = seq, RouteError, message.Codec_JSON, payload
+	return res, nil
+}
+
+// SendError send a structured error response of req to channel.
+func SendError(c Channel, req *message.ProtocolMessage, err error) error {
+	res, e := newErrorResponse(&message.ProtocolMessage{}, req.GetRoute(), req.GetSeq(), err)
+	if e != nil {
+		return e
+	}
+	stampReply(req, res)
+	return c.Send(res)
+}
+
+func sendErrorResponse(c Channel, req *message.ProtocolMessage, err error) {
+	route := req.GetRoute()
+	res, e := newErrorResponse(req, route, req.GetSeq(), err)
+	if e != nil {
+		logk.Error("encode error response failed", zap.Int32("route", route), zap.Error(e))
+		return
+	}
+	stampReply(req, res)
+	if e = c.Send(res); e != nil {
+		logk.Error("send error response failed", zap.Int32("route", route), zap.Error(e))
+	}
+}
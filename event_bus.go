@@ -0,0 +1,206 @@
+package smart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"github.com/bytedance/gopkg/util/gopool"
+	"go.uber.org/zap"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// EventSubscriber optional interface of Module, SubscribeEvents is called when module registered to a router,
+// returned subscriptions are canceled when module unregistered or replaced.
+type EventSubscriber interface {
+	SubscribeEvents(bus *EventBus) []*Subscription
+}
+
+// EventBus typed event bus, every Router owns one. events are dispatched by exact type of event.
+type EventBus struct {
+	lock sync.RWMutex
+	subs map[reflect.Type][]*Subscription
+	pool gopool.Pool // dedicated pool for subscriptions with OnEventPool
+}
+
+// NewEventBus create event bus, poolSize is the max goroutines of dedicated pool, < 1 means core * 2
+func NewEventBus(name string, poolSize int) *EventBus {
+	if poolSize < 1 {
+		poolSize = runtime.NumCPU() * 2
+	}
+	return &EventBus{
+		subs: map[reflect.Type][]*Subscription{},
+		pool: gopool.NewPool("smart-event-"+name, int32(poolSize), gopool.NewConfig()),
+	}
+}
+
+// EventBusOf returns event bus of handler context, bus of DefaultRouter if ctx does not carry one
+func EventBusOf(ctx context.Context) *EventBus {
+	if bus, ok := ctx.Value(CtxKeyEventBus).(*EventBus); ok {
+		return bus
+	}
+	return hManager.bus
+}
+
+// SubscribeOption dispatch option of subscription.
+// handlers not run on publisher get context of publisher without its deadline and cancellation.
+type SubscribeOption func(s *Subscription)
+
+// OnPublisher run handler synchronously on the goroutine of publisher(worker of publishing handler), it is default.
+// error of handler is returned to publisher.
+func OnPublisher() SubscribeOption {
+	return func(s *Subscription) {
+		s.dispatch = nil
+	}
+}
+
+// OnWorker run handler on worker w in publishing order
+func OnWorker(w Worker) SubscribeOption {
+	return func(s *Subscription) {
+		s.dispatch = w.Run
+	}
+}
+
+// OnChannel run handler on worker of channel c in publishing order, so it never races with handlers of c
+func OnChannel(c Channel) SubscribeOption {
+	return func(s *Subscription) {
+		s.dispatch = func(_ context.Context, f func()) {
+			c.LaterRun(f)
+		}
+	}
+}
+
+// OnEventPool run handler on dedicated pool of bus, events of a subscription are still handled in publishing order
+func OnEventPool() SubscribeOption {
+	return func(s *Subscription) {
+		s.serial = true
+	}
+}
+
+// Subscription handle of subscribed event handler
+type Subscription struct {
+	bus      *EventBus
+	et       reflect.Type
+	name     string
+	handle   func(ctx context.Context, e interface{}) error
+	dispatch func(ctx context.Context, f func()) // nil means run on publisher
+	serial   bool                                // run on pool of bus one by one
+	lock     sync.Mutex
+	queue    []func()
+	running  bool
+}
+
+// Subscribe subscribe event of type T on bus
+func Subscribe[T any](bus *EventBus, handler func(ctx context.Context, e T) error, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{
+		bus:  bus,
+		et:   reflect.TypeOf((*T)(nil)).Elem(),
+		name: runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name(),
+		handle: func(ctx context.Context, e interface{}) error {
+			return handler(ctx, e.(T))
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	// copy on write, publisher iterates subscriptions without lock
+	subs := make([]*Subscription, 0, len(bus.subs[s.et])+1)
+	bus.subs[s.et] = append(append(subs, bus.subs[s.et]...), s)
+	return s
+}
+
+// Publish publish event e to bus of ctx(see EventBusOf), returns errors of handlers run on publisher
+func Publish[T any](ctx context.Context, e T) error {
+	return PublishTo(EventBusOf(ctx), ctx, e)
+}
+
+// PublishTo publish event e to bus, returns errors of handlers run on publisher
+func PublishTo[T any](bus *EventBus, ctx context.Context, e T) error {
+	bus.lock.RLock()
+	subs := bus.subs[reflect.TypeOf((*T)(nil)).Elem()]
+	bus.lock.RUnlock()
+	var errs []error
+	for _, s := range subs {
+		if err := s.deliver(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cancel stop receiving events, events already dispatched to worker or pool are still handled
+func (s *Subscription) Cancel() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	subs := s.bus.subs[s.et]
+	for idx, sub := range subs {
+		if sub == s {
+			s.bus.subs[s.et] = append(subs[:idx:idx], subs[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Subscription) deliver(ctx context.Context, e interface{}) error {
+	if s.serial || s.dispatch != nil {
+		// handler runs after publisher returned, deadline of publishing handler is canceled by then
+		ctx = context.WithoutCancel(ctx)
+	}
+	if s.serial {
+		s.enqueue(func() { _ = s.call(ctx, e) })
+		return nil
+	} else if s.dispatch != nil {
+		s.dispatch(ctx, func() { _ = s.call(ctx, e) })
+		return nil
+	}
+	return s.call(ctx, e)
+}
+
+// enqueue keep publishing order of subscription, only one task of a subscription runs on pool at a time
+func (s *Subscription) enqueue(task func()) {
+	s.lock.Lock()
+	s.queue = append(s.queue, task)
+	if s.running {
+		s.lock.Unlock()
+		return
+	}
+	s.running = true
+	s.lock.Unlock()
+	s.bus.pool.Go(s.drain)
+}
+
+func (s *Subscription) drain() {
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		task := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+		task()
+	}
+}
+
+// call isolate panic and error of handler from publisher and other subscriptions
+func (s *Subscription) call(ctx context.Context, e interface{}) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("event handler panic: %v", p)
+			logk.Error("event handler panic", zap.String("event", s.et.String()), zap.String("handler", s.name),
+				zap.Any("recover", p), zap.ByteString("stack", debug.Stack()))
+		}
+	}()
+	if err = s.handle(ctx, e); err != nil {
+		logk.Error("event handler error", zap.String("event", s.et.String()), zap.String("handler", s.name), zap.Error(err))
+	}
+	return err
+}
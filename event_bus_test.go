@@ -0,0 +1,101 @@
+package smart
+
+import (
+	"context"
+	"errors"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/gookit/event"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type LevelUpEvent struct {
+	PlayerId int64
+	Level    int
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus("test", 4)
+	var sync1, sync2 []int
+	Subscribe(bus, func(ctx context.Context, e LevelUpEvent) error {
+		panic("broken subscriber")
+	})
+	Subscribe(bus, func(ctx context.Context, e LevelUpEvent) error {
+		sync1 = append(sync1, e.Level)
+		return errors.New("quest not found")
+	})
+	sub2 := Subscribe(bus, func(ctx context.Context, e LevelUpEvent) error {
+		sync2 = append(sync2, e.Level)
+		return nil
+	})
+	// ordering of pool subscription
+	var pooled []int
+	wg := &sync.WaitGroup{}
+	wg.Add(100)
+	Subscribe(bus, func(ctx context.Context, e LevelUpEvent) error {
+		pooled = append(pooled, e.Level)
+		wg.Done()
+		return nil
+	}, OnEventPool())
+	// other event type
+	Subscribe(bus, func(ctx context.Context, e *LevelUpEvent) error {
+		t.Error("should not receive event of other type")
+		return nil
+	})
+	ctx := context.WithValue(context.Background(), CtxKeyEventBus, bus)
+	err := Publish(ctx, LevelUpEvent{PlayerId: 1, Level: 0})
+	assert.NotNil(t, err)
+	sub2.Cancel()
+	for level := 1; level < 100; level++ {
+		_ = Publish(ctx, LevelUpEvent{PlayerId: 1, Level: level})
+	}
+	wg.Wait()
+	assert.Len(t, sync1, 100)
+	assert.Equal(t, []int{0}, sync2)
+	for idx, level := range pooled {
+		assert.Equal(t, idx, level)
+	}
+}
+
+type publishModule struct{}
+
+func (m *publishModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *publishModule) Events() []string {
+	return nil
+}
+
+func (m *publishModule) Name() string {
+	return "publishModule"
+}
+
+func (m *publishModule) Publish4101(ctx context.Context, channel Channel, req *Req) error {
+	return Publish(ctx, LevelUpEvent{PlayerId: 1, Level: req.Ping})
+}
+
+func TestEventBusAsyncContext(t *testing.T) {
+	r := NewRouter().(*handlerManager)
+	assert.Nil(t, r.RegisterModule(&publishModule{}, WithRouteTimeout(4101, time.Minute)))
+	w := NewWorkerManager(1, RoundRobin).Pick(0)
+	done := make(chan error, 2)
+	for _, opt := range []SubscribeOption{OnEventPool(), OnWorker(w)} {
+		Subscribe(r.bus, func(ctx context.Context, e LevelUpEvent) error {
+			done <- ctx.Err()
+			return nil
+		}, opt)
+	}
+	c := &mockChannel{ctx: context.Background()}
+	r.invokeHandler(c.ctx, c, &message.ProtocolMessage{Route: 4101, Codec: message.Codec_JSON, Payload: []byte(`{"ping":1}`)})
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("async subscriber not called")
+		}
+	}
+}
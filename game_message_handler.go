@@ -13,6 +13,6 @@ type gameMessageHandler struct {
 }
 
 func (gsh *gameMessageHandler) OnMessage(ctx context.Context, h Channel, m *message.ProtocolMessage) error {
-	hManager.invokeHandler(ctx, h, m)
+	routerOf(h).invokeHandler(ctx, h, m)
 	return nil
 }
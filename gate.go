@@ -0,0 +1,583 @@
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/codec"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gateHeaders headers used between gate and backends, removed before reply sent to client
+var gateHeaders = []string{HeaderFromClient, HeaderToClient, HeaderFromService, HeaderToService, HeaderUserId}
+
+// GateOption option of NewGate
+type GateOption func(g *Gate)
+
+// WithGateName name of gate service, stamped to HeaderFromService of forwarded messages
+func WithGateName(name string) GateOption {
+	return func(g *Gate) {
+		g.name = name
+	}
+}
+
+// WithDefaultService messages whose service can not be selected by route are forwarded to service
+func WithDefaultService(service string) GateOption {
+	return func(g *Gate) {
+		g.defaultService = service
+	}
+}
+
+// WithServiceSelector select backend service of message by route, empty result falls back to default service
+func WithServiceSelector(selector func(route int32) string) GateOption {
+	return func(g *Gate) {
+		g.selector = selector
+	}
+}
+
+// WithBackendInitializers initializers of links to backends, e.g. codec and byte order.
+// default is smart codec with LittleEndian
+func WithBackendInitializers(initializers ...ChannelInitializer) GateOption {
+	return func(g *Gate) {
+		g.initializers = initializers
+	}
+}
+
+// WithBackendTLS links to backends over tls, e.g. mutual tls across data centers. see TLSConfig.ClientConfig
+func WithBackendTLS(conf *tls.Config) GateOption {
+	return func(g *Gate) {
+		g.tls = conf
+	}
+}
+
+// WithReconnectBackoff backoff of reconnecting to backend, doubled after every failure until max
+func WithReconnectBackoff(min, max time.Duration) GateOption {
+	return func(g *Gate) {
+		g.minBackoff, g.maxBackoff = min, max
+	}
+}
+
+// WithSessionDirectory users bound to client connections are registered to directory with id of gate,
+// backends push messages to users through the gate found in directory, see Pusher
+func WithSessionDirectory(id string, dir SessionDirectory) GateOption {
+	return func(g *Gate) {
+		g.id, g.directory = id, dir
+	}
+}
+
+// Gate forward messages of clients to backend services and route replies of backends back to clients.
+// backend of a service is picked by consistent hash of user id(or connection id before login),
+// and pinned to client connection until the backend is gone.
+// backend reply HeaderUserId to bind the user to client connection.
+type Gate struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	name           string
+	defaultService string
+	selector       func(route int32) string
+	initializers   []ChannelInitializer
+	tls            *tls.Config
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	lock           sync.RWMutex
+	services       map[string]*backendGroup
+	sessions       sync.Map // key=fd of client, value=*gateSession
+	id             string
+	directory      SessionDirectory
+	users          sync.Map // key=user id, value=*gateSession
+}
+
+// NewGate create a gate, add backends by AddBackend, and attach it to gate server by Gate.Initializer
+func NewGate(opts ...GateOption) *Gate {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Gate{
+		ctx:          ctx,
+		cancel:       cancel,
+		name:         "gate",
+		minBackoff:   100 * time.Millisecond,
+		maxBackoff:   10 * time.Second,
+		services:     map[string]*backendGroup{},
+		initializers: defaultLinkInitializers(),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// defaultLinkInitializers initializers of links between smart services
+func defaultLinkInitializers() []ChannelInitializer {
+	return []ChannelInitializer{
+		WithByteOrder(func() binary.ByteOrder { return binary.LittleEndian }),
+		WithCodec(func() codec.Codec { return codec.NewSmartCodec(binary.LittleEndian) }),
+	}
+}
+
+// Initializer attach gate to client channels of gate server
+func (g *Gate) Initializer() ChannelInitializer {
+	return func(channel Channel) {
+		AppendHandler(func() ChannelHandler { return g })(channel)
+		AppendMessageHandler(func() MessageHandler { return NewGateMessageHandler(g) })(channel)
+	}
+}
+
+// AddBackend add backend instance of service, link to it is established in background and reconnected when lost.
+// weight < 1 is treated as 1
+func (g *Gate) AddBackend(service, network, addr string, weight int) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.ctx.Err() != nil {
+		return errors.New("gate is closed")
+	}
+	group := g.groupLocked(service)
+	if _, ok := group.backends[addr]; ok {
+		return errors.Errorf("backend [%s] of service [%s] already exists", addr, service)
+	}
+	g.addBackendLocked(group, network, addr, weight)
+	return nil
+}
+
+// Discover keep backends of services same as healthy instances found by discovery until ctx done
+func (g *Gate) Discover(ctx context.Context, d Discovery, services ...string) error {
+	for _, service := range services {
+		service := service
+		if err := d.Watch(ctx, service, func(instances []Instance) {
+			g.syncBackends(service, healthyInstances(instances))
+		}); err != nil {
+			return errors.WithMessage(err, "discover service: "+service)
+		}
+	}
+	return nil
+}
+
+// syncBackends add new instances, remove instances gone and update weight of backends of service
+func (g *Gate) syncBackends(service string, instances []Instance) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.ctx.Err() != nil {
+		return
+	}
+	group := g.groupLocked(service)
+	desired := make(map[string]Instance, len(instances))
+	for _, ins := range instances {
+		desired[ins.Address] = ins
+	}
+	group.lock.RLock()
+	var removed []string
+	for addr := range group.backends {
+		if _, ok := desired[addr]; !ok {
+			removed = append(removed, addr)
+		}
+	}
+	group.lock.RUnlock()
+	for _, addr := range removed {
+		group.remove(addr).close()
+	}
+	for addr, ins := range desired {
+		if _, ok := group.backends[addr]; ok {
+			group.setWeight(addr, ins.Weight)
+		} else {
+			g.addBackendLocked(group, ins.network(), addr, ins.Weight)
+		}
+	}
+	logk.Info("backends of service changed", zap.String("service", service), zap.Int("instances", len(instances)))
+}
+
+func (g *Gate) groupLocked(service string) *backendGroup {
+	group, ok := g.services[service]
+	if !ok {
+		group = &backendGroup{service: service, backends: map[string]*backend{}, ring: newHashRing()}
+		g.services[service] = group
+	}
+	return group
+}
+
+func (g *Gate) addBackendLocked(group *backendGroup, network, addr string, weight int) {
+	b := &backend{gate: g, group: group, network: network, addr: addr, weight: weight}
+	group.add(b)
+	go b.connect()
+}
+
+// RemoveBackend close link to backend, clients pinned to it are moved to other backends of service
+func (g *Gate) RemoveBackend(service, addr string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	group, ok := g.services[service]
+	if !ok {
+		return errors.Errorf("service [%s] not found", service)
+	}
+	b := group.remove(addr)
+	if b == nil {
+		return errors.Errorf("backend [%s] of service [%s] not found", addr, service)
+	}
+	b.close()
+	return nil
+}
+
+// Close close links to all backends
+func (g *Gate) Close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.cancel()
+	for _, group := range g.services {
+		for addr := range group.backends {
+			group.remove(addr).close()
+		}
+	}
+}
+
+func (g *Gate) OnOpen(channel Channel) {
+	g.session(channel)
+}
+
+func (g *Gate) OnClose(channel Channel) {
+	v, ok := g.sessions.LoadAndDelete(channel.GetFd())
+	if !ok {
+		return
+	}
+	s := v.(*gateSession)
+	s.bindLock.Lock()
+	defer s.bindLock.Unlock()
+	s.closed = true
+	if uid := s.user(); len(uid) > 0 && g.users.CompareAndDelete(uid, s) && g.directory != nil {
+		if err := g.directory.Unbind(g.ctx, uid, g.id); err != nil {
+			logk.Error("unbind user from session directory failed", zap.String("user", uid), zap.Error(err))
+		}
+	}
+}
+
+// bindUser bind user to client session, the previous session of user is replaced. closed session is not bound,
+// it may be loaded by reply just before the client closed.
+func (g *Gate) bindUser(s *gateSession, uid string) {
+	s.bindLock.Lock()
+	defer s.bindLock.Unlock()
+	if s.closed || s.user() == uid {
+		return
+	}
+	s.bind(uid)
+	g.users.Store(uid, s)
+	if g.directory != nil {
+		if err := g.directory.Bind(g.ctx, uid, g.id); err != nil {
+			logk.Error("bind user to session directory failed", zap.String("user", uid), zap.Error(err))
+		}
+	}
+}
+
+func (g *Gate) session(channel Channel) *gateSession {
+	s, _ := g.sessions.LoadOrStore(channel.GetFd(), &gateSession{channel: channel, pinned: map[string]*backend{}})
+	return s.(*gateSession)
+}
+
+func (g *Gate) serviceOf(route int32) string {
+	if g.selector != nil {
+		if service := g.selector(route); len(service) > 0 {
+			return service
+		}
+	}
+	return g.defaultService
+}
+
+// pick backend of service for client session, nil if no backend available
+func (g *Gate) pick(s *gateSession, service string) *backend {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b, ok := s.pinned[service]; ok && b.alive() {
+		return b
+	}
+	g.lock.RLock()
+	group, ok := g.services[service]
+	g.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	key := s.userId
+	if len(key) == 0 {
+		key = "fd-" + strconv.Itoa(s.channel.GetFd())
+	}
+	b := group.get(key)
+	if b != nil {
+		s.pinned[service] = b
+	}
+	return b
+}
+
+// forward message of client to backend, client receives ErrCodeServiceUnavailable if no backend available,
+// ErrCodeBadRequest for routes of framework
+func (g *Gate) forward(c Channel, m *message.ProtocolMessage) error {
+	if m.GetRoute() < 0 { // routes of framework, e.g. RouteGateHello, never come from clients
+		return SendError(c, m, NewErrorf(ErrCodeBadRequest, "route [%d] not allowed", m.GetRoute()))
+	}
+	s := g.session(c)
+	service := g.serviceOf(m.GetRoute())
+	b := g.pick(s, service)
+	if b == nil {
+		return SendError(c, m, NewErrorf(ErrCodeServiceUnavailable, "service [%s] unavailable", service))
+	}
+	if m.Header == nil {
+		m.Header = map[string]string{}
+	}
+	// headers between gate and backends are never trusted from clients
+	for _, h := range gateHeaders {
+		delete(m.Header, h)
+	}
+	fd := strconv.Itoa(c.GetFd())
+	m.Header[HeaderFrom] = fd
+	m.Header[HeaderFromClient] = fd
+	m.Header[HeaderFromService] = g.name
+	m.Header[HeaderToService] = service
+	if uid := s.user(); len(uid) > 0 {
+		m.Header[HeaderUserId] = uid
+	}
+	if err := b.send(m); err != nil {
+		logk.Warn("forward message to backend failed",
+			zap.String("service", service), zap.String("backend", b.addr), zap.Int32("route", m.GetRoute()), zap.Error(err))
+		for _, h := range gateHeaders {
+			delete(m.Header, h)
+		}
+		return SendError(c, m, NewErrorf(ErrCodeServiceUnavailable, "service [%s] unavailable", service))
+	}
+	return nil
+}
+
+// reply route message of backend to the client of HeaderToClient
+func (g *Gate) reply(b *backend, m *message.ProtocolMessage) error {
+	if m.GetRoute() == RoutePush {
+		return g.deliver(m)
+	}
+	fd, err := strconv.Atoi(m.GetHeader()[HeaderToClient])
+	if err != nil {
+		logk.Warn("backend message without client", zap.String("backend", b.addr), zap.Int32("route", m.GetRoute()))
+		return nil
+	}
+	v, ok := g.sessions.Load(fd)
+	if !ok { // client gone
+		return nil
+	}
+	s := v.(*gateSession)
+	if uid := m.GetHeader()[HeaderUserId]; len(uid) > 0 {
+		g.bindUser(s, uid)
+	}
+	for _, h := range gateHeaders {
+		delete(m.Header, h)
+	}
+	return s.channel.Send(m)
+}
+
+// deliver message pushed by backend to users connected to gate, users not on gate are ignored
+func (g *Gate) deliver(m *message.ProtocolMessage) error {
+	msg := &message.ProtocolMessage{}
+	if err := proto.Unmarshal(m.GetPayload(), msg); err != nil {
+		logk.Error("decode pushed message failed", zap.Error(err))
+		return nil
+	}
+	for _, uid := range strings.Split(m.GetHeader()[HeaderToUsers], ",") {
+		if s, ok := g.users.Load(uid); ok {
+			if err := s.(*gateSession).channel.Send(msg); err != nil {
+				logk.Warn("deliver pushed message failed", zap.String("user", uid), zap.Int32("route", msg.GetRoute()), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// gateSession client connection on gate
+type gateSession struct {
+	channel  Channel
+	lock     sync.Mutex
+	userId   string
+	pinned   map[string]*backend // key=service
+	bindLock sync.Mutex          // serialize binding of user with closing of session
+	closed   bool                // guarded by bindLock
+}
+
+func (s *gateSession) user() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.userId
+}
+
+// bind user to session, backends already pinned are kept
+func (s *gateSession) bind(userId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.userId = userId
+}
+
+// backendGroup backends of a service
+type backendGroup struct {
+	service  string
+	lock     sync.RWMutex
+	backends map[string]*backend // key=addr
+	ring     *hashRing           // connected backends
+}
+
+func (bg *backendGroup) add(b *backend) {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	bg.backends[b.addr] = b
+}
+
+func (bg *backendGroup) setWeight(addr string, weight int) {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	if b, ok := bg.backends[addr]; ok && b.weight != weight {
+		b.weight = weight
+		bg.rebuildLocked()
+	}
+}
+
+func (bg *backendGroup) remove(addr string) *backend {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	b, ok := bg.backends[addr]
+	if !ok {
+		return nil
+	}
+	delete(bg.backends, addr)
+	bg.rebuildLocked()
+	return b
+}
+
+// rebuild ring of connected backends, called when backend connected or disconnected
+func (bg *backendGroup) rebuild() {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	bg.rebuildLocked()
+}
+
+func (bg *backendGroup) rebuildLocked() {
+	ring := newHashRing()
+	for addr, b := range bg.backends {
+		if b.alive() {
+			ring.add(addr, b.weight)
+		}
+	}
+	bg.ring = ring
+}
+
+func (bg *backendGroup) get(key string) *backend {
+	bg.lock.RLock()
+	defer bg.lock.RUnlock()
+	return bg.backends[bg.ring.get(key)]
+}
+
+// backend link of gate to a backend instance
+type backend struct {
+	gate    *Gate
+	group   *backendGroup
+	network string
+	addr    string
+	weight  int
+	lock    sync.RWMutex
+	channel Channel
+	removed bool
+}
+
+func (b *backend) alive() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return !b.removed && b.channel != nil
+}
+
+func (b *backend) send(m *message.ProtocolMessage) error {
+	b.lock.RLock()
+	c := b.channel
+	b.lock.RUnlock()
+	if c == nil {
+		return errors.Errorf("backend [%s] is not connected", b.addr)
+	}
+	return c.Send(m)
+}
+
+// connect dial backend until connected, gate closed or backend removed
+func (b *backend) connect() {
+	backoff := b.gate.minBackoff
+	initializers := append(append([]ChannelInitializer{}, b.gate.initializers...),
+		AppendHandler(func() ChannelHandler { return b }),
+		AppendMessageHandler(func() MessageHandler { return b }),
+	)
+	for {
+		c, err := dialLink(b.gate.ctx, b.network, b.addr, b.gate.tls, initializers)
+		if err == nil {
+			b.lock.Lock()
+			if b.removed {
+				b.lock.Unlock()
+				_ = c.Close()
+				return
+			}
+			b.channel = c
+			b.lock.Unlock()
+			// tell backend which gate the link belongs to, so it can push through the link
+			if len(b.gate.id) > 0 {
+				if err = c.Send(&message.ProtocolMessage{Route: RouteGateHello, Header: map[string]string{HeaderGateId: b.gate.id}}); err != nil {
+					logk.Warn("say hello to backend failed", zap.String("backend", b.addr), zap.Error(err))
+				}
+			}
+			b.group.rebuild()
+			logk.Info("backend connected", zap.String("service", b.group.service), zap.String("backend", b.addr))
+			return
+		}
+		logk.Warn("connect backend failed", zap.String("service", b.group.service), zap.String("backend", b.addr),
+			zap.Duration("retry", backoff), zap.Error(err))
+		select {
+		case <-b.gate.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if b.isRemoved() {
+			return
+		}
+		if backoff *= 2; backoff > b.gate.maxBackoff {
+			backoff = b.gate.maxBackoff
+		}
+	}
+}
+
+func (b *backend) isRemoved() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.removed
+}
+
+func (b *backend) close() {
+	b.lock.Lock()
+	c := b.channel
+	b.removed, b.channel = true, nil
+	b.lock.Unlock()
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+func (b *backend) OnOpen(channel Channel) {
+}
+
+// OnClose link lost, reconnect unless backend removed
+func (b *backend) OnClose(channel Channel) {
+	b.lock.Lock()
+	if b.channel != channel {
+		b.lock.Unlock()
+		return
+	}
+	b.channel = nil
+	removed := b.removed
+	b.lock.Unlock()
+	b.group.rebuild()
+	if !removed && b.gate.ctx.Err() == nil {
+		logk.Warn("backend disconnected, reconnecting", zap.String("service", b.group.service), zap.String("backend", b.addr))
+		go b.connect()
+	}
+}
+
+// OnMessage reply of backend
+func (b *backend) OnMessage(ctx context.Context, channel Channel, msg *message.ProtocolMessage) error {
+	return b.gate.reply(b, msg)
+}
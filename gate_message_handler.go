@@ -3,24 +3,17 @@ package smart
 import (
 	"context"
 	"gitee.com/ywengineer/smart/message"
-	"strconv"
 )
 
-func NewGateMessageHandler() MessageHandler {
-	return &gateMessageHandler{}
+// NewGateMessageHandler forward client messages to backends of gate, see Gate.Initializer
+func NewGateMessageHandler(gate *Gate) MessageHandler {
+	return &gateMessageHandler{gate: gate}
 }
 
 type gateMessageHandler struct {
+	gate *Gate
 }
 
 func (gsh *gateMessageHandler) OnMessage(ctx context.Context, h Channel, m *message.ProtocolMessage) error {
-	if m.Header == nil {
-		m.Header = map[string]string{}
-	}
-	m.Header[HeaderFrom] = strconv.Itoa(h.GetFd())
-	// load balance redirect to
-	//bytes, _ := proto.Marshal(m)
-	//
-
-	return nil
+	return gsh.gate.forward(h, m)
 }
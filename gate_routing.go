@@ -0,0 +1,108 @@
+package smart
+
+import (
+	"gitee.com/ywengineer/smart-kit/pkg/loaders"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"sort"
+	"sync/atomic"
+)
+
+// ServiceRoute routes in [From, To] are forwarded to Service by gate
+type ServiceRoute struct {
+	From    int32  `json:"from" yaml:"from"`
+	To      int32  `json:"to" yaml:"to"`
+	Service string `json:"service" yaml:"service"`
+}
+
+// RoutingConf routing table of gate, e.g.
+//
+//	routing:
+//	  default: game
+//	  routes:
+//	    - { from: 1000, to: 1999, service: game }
+//	    - { from: 2000, to: 2999, service: chat }
+type RoutingConf struct {
+	Default string         `json:"default" yaml:"default"`
+	Routes  []ServiceRoute `json:"routes" yaml:"routes"`
+}
+
+// routingDoc routing table is declared under key "routing" of config
+type routingDoc struct {
+	Routing RoutingConf `json:"routing" yaml:"routing"`
+}
+
+// RoutingTable map route ranges to backend services, safe to reload while gate is running
+type RoutingTable struct {
+	conf atomic.Pointer[RoutingConf] // routes sorted by From
+}
+
+// NewRoutingTable create routing table, returns error if ranges are invalid or overlapped
+func NewRoutingTable(conf RoutingConf) (*RoutingTable, error) {
+	rt := &RoutingTable{}
+	if err := rt.Update(conf); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// WithRoutingTable select backend service of message by routing table
+func WithRoutingTable(rt *RoutingTable) GateOption {
+	return WithServiceSelector(rt.ServiceOf)
+}
+
+// Update replace routes of table, table is unchanged when conf is invalid
+func (rt *RoutingTable) Update(conf RoutingConf) error {
+	routes := append([]ServiceRoute{}, conf.Routes...)
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].From < routes[j].From
+	})
+	for i, r := range routes {
+		if len(r.Service) == 0 {
+			return errors.Errorf("service of routes [%d, %d] is empty", r.From, r.To)
+		}
+		if r.From > r.To {
+			return errors.Errorf("invalid routes [%d, %d] of service [%s]", r.From, r.To, r.Service)
+		}
+		if i > 0 && routes[i-1].To >= r.From {
+			return errors.Errorf("routes [%d, %d] of service [%s] overlap with [%d, %d] of service [%s]",
+				r.From, r.To, r.Service, routes[i-1].From, routes[i-1].To, routes[i-1].Service)
+		}
+	}
+	rt.conf.Store(&RoutingConf{Default: conf.Default, Routes: routes})
+	return nil
+}
+
+// ServiceOf returns service of route, default service if route is not in any range
+func (rt *RoutingTable) ServiceOf(route int32) string {
+	conf := rt.conf.Load()
+	idx := sort.Search(len(conf.Routes), func(i int) bool {
+		return conf.Routes[i].To >= route
+	})
+	if idx < len(conf.Routes) && conf.Routes[idx].From <= route {
+		return conf.Routes[idx].Service
+	}
+	return conf.Default
+}
+
+// Watch reload routing table declared under key "routing" when config of server changed, see Server.WatchConfig,
+// e.g. the gate server, so routes of new services take effect without restarting gate.
+// invalid config is logged and ignored.
+func (rt *RoutingTable) Watch(srv Server) {
+	srv.WatchConfig(rt.reload)
+}
+
+func (rt *RoutingTable) reload(data string, loader loaders.SmartLoader) error {
+	doc := &routingDoc{}
+	if err := loader.Unmarshal([]byte(data), doc); err != nil {
+		logk.Error("unmarshal routing table when watch", zap.Error(err))
+		return err
+	}
+	if err := rt.Update(doc.Routing); err != nil {
+		logk.Error("invalid routing table, keep the old one", zap.Error(err))
+		return err
+	}
+	logk.Info("routing table reloaded", zap.Int("ranges", len(doc.Routing.Routes)), zap.String("default", doc.Routing.Default))
+	return nil
+}
@@ -0,0 +1,242 @@
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	loader2 "gitee.com/ywengineer/smart-kit/pkg/loaders"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"testing"
+)
+
+type fdChannel struct {
+	mockChannel
+	fd int
+}
+
+func (c *fdChannel) GetFd() int { return c.fd }
+
+// addConnectedBackend add backend to gate as if it is connected
+func addConnectedBackend(g *Gate, service, addr string) *fdChannel {
+	group, ok := g.services[service]
+	if !ok {
+		group = &backendGroup{service: service, backends: map[string]*backend{}, ring: newHashRing()}
+		g.services[service] = group
+	}
+	c := &fdChannel{mockChannel: mockChannel{ctx: context.Background()}}
+	group.add(&backend{gate: g, group: group, addr: addr, weight: 1, channel: c})
+	group.rebuild()
+	return c
+}
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing().add("a", 1).add("b", 1).add("c", 2)
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[ring.get(strconv.Itoa(i))]++
+	}
+	assert.Len(t, counts, 3)
+	assert.Greater(t, counts["c"], counts["a"])
+	// keys of remaining nodes stay
+	moved := 0
+	shrunk := newHashRing().add("a", 1).add("c", 2)
+	for i := 0; i < 4000; i++ {
+		if n := ring.get(strconv.Itoa(i)); n != "b" && n != shrunk.get(strconv.Itoa(i)) {
+			moved++
+		}
+	}
+	assert.Zero(t, moved)
+}
+
+func TestGateForward(t *testing.T) {
+	g := NewGate(WithGateName("gate-1"), WithDefaultService("game"), WithServiceSelector(func(route int32) string {
+		if route >= 2000 {
+			return "chat"
+		}
+		return ""
+	}))
+	defer g.Close()
+	b1, b2 := addConnectedBackend(g, "game", "b1"), addConnectedBackend(g, "game", "b2")
+	client := &fdChannel{mockChannel: mockChannel{ctx: context.Background()}, fd: 7}
+	g.OnOpen(client)
+	// forward with gate headers, pinned to the same backend
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, g.forward(client, &message.ProtocolMessage{Seq: int32(i), Route: 1001}))
+	}
+	backend := b1
+	if len(b1.sent) == 0 {
+		backend = b2
+	}
+	assert.Len(t, backend.sent, 3)
+	assert.Equal(t, "7", backend.sent[0].Header[HeaderFromClient])
+	assert.Equal(t, "gate-1", backend.sent[0].Header[HeaderFromService])
+	assert.Equal(t, "game", backend.sent[0].Header[HeaderToService])
+	// headers faked by client are dropped before login
+	assert.Nil(t, g.forward(client, &message.ProtocolMessage{Seq: 3, Route: 1001, Header: map[string]string{
+		HeaderUserId: "admin", HeaderToClient: "8", HeaderFromService: "gm", HeaderTraceId: "t-1",
+	}}))
+	assert.Len(t, backend.sent, 4)
+	assert.NotContains(t, backend.sent[3].Header, HeaderUserId)
+	assert.NotContains(t, backend.sent[3].Header, HeaderToClient)
+	assert.Equal(t, "gate-1", backend.sent[3].Header[HeaderFromService])
+	assert.Equal(t, "t-1", backend.sent[3].Header[HeaderTraceId])
+	// reply routed back to client and binds user
+	res := &message.ProtocolMessage{Seq: 0, Route: 1002, Header: map[string]string{HeaderToClient: "7", HeaderUserId: "u-1"}}
+	assert.Nil(t, g.reply(nil, res))
+	assert.Len(t, client.sent, 1)
+	assert.Empty(t, client.sent[0].Header)
+	assert.Nil(t, g.forward(client, &message.ProtocolMessage{Route: 1003, Header: map[string]string{HeaderUserId: "admin"}}))
+	assert.Equal(t, "u-1", backend.sent[4].Header[HeaderUserId])
+	// routes of framework are not forwarded
+	assert.Nil(t, g.forward(client, &message.ProtocolMessage{Seq: 8, Route: RouteGateHello, Header: map[string]string{HeaderGateId: "gate-2"}}))
+	assert.Len(t, backend.sent, 5)
+	assert.Len(t, client.sent, 2)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeBadRequest)), client.sent[1].Header[HeaderErrorCode])
+	// no backend of chat
+	assert.Nil(t, g.forward(client, &message.ProtocolMessage{Seq: 9, Route: 2001}))
+	assert.Len(t, client.sent, 3)
+	assert.Equal(t, RouteError, client.sent[2].Route)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeServiceUnavailable)), client.sent[2].Header[HeaderErrorCode])
+	assert.Empty(t, client.sent[2].Header[HeaderToClient])
+	// client gone
+	g.OnClose(client)
+	assert.Nil(t, g.reply(nil, &message.ProtocolMessage{Header: map[string]string{HeaderToClient: "7"}}))
+	assert.Len(t, client.sent, 3)
+}
+
+func TestGateBindClosedSession(t *testing.T) {
+	dir := NewMemorySessionDirectory()
+	g := NewGate(WithSessionDirectory("gate-1", dir))
+	defer g.Close()
+	client := &fdChannel{mockChannel: mockChannel{ctx: context.Background()}, fd: 3}
+	g.OnOpen(client)
+	// reply of backend loaded session just before client closed
+	s := g.session(client)
+	g.OnClose(client)
+	g.bindUser(s, "u-1")
+	_, ok := g.users.Load("u-1")
+	assert.False(t, ok)
+	gates, err := dir.Lookup(context.Background(), "u-1")
+	assert.Nil(t, err)
+	assert.Empty(t, gates)
+}
+
+func TestRoutingTable(t *testing.T) {
+	rt, err := NewRoutingTable(RoutingConf{Default: "game", Routes: []ServiceRoute{
+		{From: 2000, To: 2999, Service: "chat"},
+		{From: 1000, To: 1999, Service: "game"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "game", rt.ServiceOf(1000))
+	assert.Equal(t, "chat", rt.ServiceOf(2999))
+	assert.Equal(t, "game", rt.ServiceOf(5000))
+	// invalid conf keeps old table
+	assert.NotNil(t, rt.Update(RoutingConf{Routes: []ServiceRoute{{From: 1000, To: 2000, Service: "a"}, {From: 2000, To: 2001, Service: "b"}}}))
+	assert.NotNil(t, rt.Update(RoutingConf{Routes: []ServiceRoute{{From: 10, To: 1, Service: "a"}}}))
+	assert.Equal(t, "chat", rt.ServiceOf(2001))
+	// reload
+	assert.Nil(t, rt.Update(RoutingConf{Routes: []ServiceRoute{{From: 3000, To: 3999, Service: "mail"}}}))
+	assert.Equal(t, "mail", rt.ServiceOf(3001))
+	assert.Empty(t, rt.ServiceOf(2001))
+}
+
+// watchLoader loader of json config keeps one watcher only, config changes are pushed by change
+type watchLoader struct {
+	loader2.SmartLoader
+	watchers int
+	change   func(data string) error
+}
+
+func (l *watchLoader) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (l *watchLoader) Watch(ctx context.Context, cb func(string) error) error {
+	l.watchers++
+	l.change = cb
+	return nil
+}
+
+func TestRoutingTableWatch(t *testing.T) {
+	rt, err := NewRoutingTable(RoutingConf{Default: "game", Routes: []ServiceRoute{{From: 2000, To: 2999, Service: "chat"}}})
+	assert.Nil(t, err)
+	loader := &watchLoader{}
+	base := newTestBase(t, func(channel Channel) {})
+	base.confLoader = loader
+	srv := &defaultServer{baseServer: base}
+	base.holder = srv
+	changed := 0
+	srv.SetOnConfigChange(func(conf loader2.Conf) { changed++ })
+	rt.Watch(srv)
+	_, err = srv.Serve(context.Background())
+	assert.Nil(t, err)
+	defer srv.Shutdown(context.Background())
+	// routing table shares the watcher of server
+	assert.Equal(t, 1, loader.watchers)
+	assert.Equal(t, "chat", rt.ServiceOf(2001))
+	// new services take effect
+	assert.Nil(t, loader.change(`{"routing":{"default":"game","routes":[{"from":2000,"to":2999,"service":"chat2"},{"from":3000,"to":3999,"service":"mail"}]}}`))
+	assert.Equal(t, "chat2", rt.ServiceOf(2001))
+	assert.Equal(t, "mail", rt.ServiceOf(3001))
+	assert.Equal(t, "game", rt.ServiceOf(1))
+	assert.Equal(t, 1, changed)
+	// overlapped and broken config are rejected, previous table is kept
+	assert.NotNil(t, loader.change(`{"routing":{"routes":[{"from":2000,"to":3000,"service":"a"},{"from":3000,"to":3999,"service":"b"}]}}`))
+	assert.NotNil(t, loader.change(`{"routing":`))
+	assert.Equal(t, "chat2", rt.ServiceOf(2001))
+	assert.Equal(t, "mail", rt.ServiceOf(3001))
+	assert.Equal(t, "game", rt.ServiceOf(1))
+}
+
+// gateLinkChannel backend side of link from gate, messages sent on it are received by gate
+type gateLinkChannel struct {
+	mockChannel
+	gate *Gate
+}
+
+func (c *gateLinkChannel) Send(msg interface{}) error {
+	return c.gate.reply(nil, proto.Clone(msg.(*message.ProtocolMessage)).(*message.ProtocolMessage))
+}
+
+func TestGatePush(t *testing.T) {
+	dir := NewMemorySessionDirectory()
+	g := NewGate(WithSessionDirectory("gate-1", dir))
+	defer g.Close()
+	pusher := NewPusher(dir)
+	link := &gateLinkChannel{mockChannel: mockChannel{ctx: context.Background()}, gate: g}
+	// hello of untrusted channel, e.g. client of game, is ignored
+	fake := &fdChannel{mockChannel: mockChannel{ctx: context.Background()}, fd: 9}
+	assert.NotNil(t, pusher.BeforeInvoke(fake.ctx, fake, &message.ProtocolMessage{Route: RouteGateHello, Header: map[string]string{HeaderGateId: "gate-1"}}))
+	_, linked := pusher.links.Load("gate-1")
+	assert.False(t, linked)
+	gateLinks.Store(link, struct{}{}) // as if initialized by TrustedInitializer
+	defer gateLinks.Delete(link)
+	assert.NotNil(t, pusher.BeforeInvoke(link.ctx, link, &message.ProtocolMessage{Route: RouteGateHello, Header: map[string]string{HeaderGateId: "gate-1"}}))
+	// two users login
+	c1, c2 := &fdChannel{mockChannel: mockChannel{ctx: context.Background()}, fd: 1}, &fdChannel{mockChannel: mockChannel{ctx: context.Background()}, fd: 2}
+	for i, c := range []*fdChannel{c1, c2} {
+		g.OnOpen(c)
+		assert.Nil(t, g.reply(nil, &message.ProtocolMessage{Route: 1002, Header: map[string]string{HeaderToClient: strconv.Itoa(c.fd), HeaderUserId: "u-" + strconv.Itoa(i+1)}}))
+	}
+	// push in order
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, pusher.PushToUser(context.Background(), "u-1", &message.ProtocolMessage{Route: 9001, Seq: int32(i)}))
+	}
+	assert.Nil(t, pusher.PushToUsers(context.Background(), []string{"u-1", "u-2", "u-3"}, &message.ProtocolMessage{Route: 9002}))
+	assert.Len(t, c1.sent, 5)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, int32(9001), c1.sent[i+1].Route)
+		assert.Equal(t, int32(i), c1.sent[i+1].Seq)
+	}
+	assert.Equal(t, int32(9002), c1.sent[4].Route)
+	assert.Len(t, c2.sent, 2)
+	// logout
+	g.OnClose(c1)
+	gates, _ := dir.Lookup(context.Background(), "u-1", "u-2")
+	assert.Equal(t, map[string]string{"u-2": "gate-1"}, gates)
+	// link lost
+	pusher.OnClose(link)
+	assert.NotNil(t, pusher.PushToUser(context.Background(), "u-2", &message.ProtocolMessage{Route: 9001}))
+}
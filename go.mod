@@ -2,8 +2,6 @@ module gitee.com/ywengineer/smart
 
 go 1.24.3
 
-toolchain go1.24.3
-
 replace gitee.com/ywengineer/smart-kit v0.0.1 => ../
 
 require (
@@ -14,6 +12,7 @@ require (
 	github.com/cloudwego/netpoll v0.7.1
 	github.com/go-spring/spring-core v1.2.1
 	github.com/gookit/event v1.1.2
+	github.com/nacos-group/nacos-sdk-go/v2 v2.3.2
 	github.com/panjf2000/gnet/v2 v2.9.2
 	github.com/pkg/errors v0.9.1
 	github.com/samber/lo v1.51.0
@@ -73,7 +72,6 @@ require (
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	github.com/nacos-group/nacos-sdk-go/v2 v2.3.2 // indirect
 	github.com/orcaman/concurrent-map v1.0.0 // indirect
 	github.com/panjf2000/ants/v2 v2.11.3 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
@@ -2,19 +2,26 @@ package smart
 
 import (
 	"context"
+	stderrors "errors"
+	"fmt"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart-kit/pkg/utilk"
 	"gitee.com/ywengineer/smart/codec"
 	"gitee.com/ywengineer/smart/message"
+	"github.com/gookit/event"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 	"reflect"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var hManager = &handlerManager{
-	_handlerMap: make(map[int32]*handlerDefinition, 1000),
-}
+var hManager = newHandlerManager("default")
+var routerSeq int32
 
 type HandlerOutType int
 
@@ -23,6 +30,7 @@ const (
 	HandlerOutTypeByteSlice
 	HandlerOutTypeProtoMessage
 	HandlerOutTypeSmart
+	HandlerOutTypeObject // any object can be encoded by codec, e.g. struct for json/msgpack
 )
 
 // handler structure
@@ -30,26 +38,69 @@ const (
 // name : string
 // in(context.Context, Channel, request): request must be a ptr
 type handlerDefinition struct {
+	module      string // name of module
 	messageCode int
 	name        string
 	method      reflect.Value
 	inType      reflect.Type // must be ptr
 	inPool      *sync.Pool
 	outType     HandlerOutType
+	outError    bool           // last out is error
+	outCodec    *message.Codec // response codec, nil means same as request
+	chain       HandlerFunc    // invoke wrapped by middlewares
+	timeout     time.Duration  // deadline budget of handler context, 0 means no deadline
+	dispatch    DispatchKey    // invocations run on worker owns the key, nil means worker of channel
+	validator   *requestValidator
+	metrics     routeMetrics
+	inflight    int64 // invocations in progress
+	removed     int32 // 1 when route is removed from route table
 }
 
-func (hd *handlerDefinition) invoke(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}) {
+func (hd *handlerDefinition) invoke(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
 	out := hd.method.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(channel), reflect.ValueOf(in)})
+	var err error
+	if hd.outError {
+		if ev := out[len(out)-1]; !ev.IsNil() {
+			err = ev.Interface().(error)
+		}
+		out = out[:len(out)-1]
+	}
 	if len(out) == 0 {
-		return nil, nil
+		return nil, nil, err
 	} else if len(out) == 1 {
-		return out[0].Interface(), nil
+		return out[0].Interface(), nil, err
 	} else {
-		return out[0].Interface(), out[1].Interface()
+		return out[0].Interface(), out[1].Interface(), err
+	}
+}
+
+func (hd *handlerDefinition) validate(in interface{}) error {
+	if hd.validator == nil {
+		return nil
+	}
+	if err := hd.validator.validate(in); err != nil {
+		atomic.AddInt64(&hd.metrics.invalid, 1)
+		return err
+	}
+	return nil
+}
+
+func (hd *handlerDefinition) handle(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+	atomic.AddInt64(&hd.metrics.invoked, 1)
+	if hd.chain == nil {
+		return hd.invoke(ctx, channel, in)
 	}
+	return hd.chain(ctx, channel, in)
 }
 
 func (hd *handlerDefinition) releaseIn(in interface{}) {
+	// reset fields, decoder such as json does not clear fields absent from payload
+	if r, ok := in.(interface{ Reset() }); ok {
+		r.Reset()
+	} else {
+		v := reflect.ValueOf(in).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
 	// release in to object pool
 	hd.inPool.Put(in)
 }
@@ -58,43 +109,191 @@ func (hd *handlerDefinition) newIn() interface{} {
 	return hd.inPool.Get()
 }
 
+func (hd *handlerDefinition) initInPool() {
+	hd.inPool = &sync.Pool{
+		New: func() interface{} {
+			in := hd.inType
+			if in.Kind() == reflect.Ptr {
+				in = in.Elem()
+			}
+			return reflect.New(in).Interface()
+		},
+	}
+}
+
+// acquire mark an invocation in progress, returns false if route already removed
+func (hd *handlerDefinition) acquire() bool {
+	atomic.AddInt64(&hd.inflight, 1)
+	if atomic.LoadInt32(&hd.removed) == 1 {
+		atomic.AddInt64(&hd.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (hd *handlerDefinition) release() {
+	atomic.AddInt64(&hd.inflight, -1)
+}
+
+// drain wait for in-flight invocations of removed route to finish
+func (hd *handlerDefinition) drain(ctx context.Context) error {
+	atomic.StoreInt32(&hd.removed, 1)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for atomic.LoadInt64(&hd.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.WithMessage(ctx.Err(), fmt.Sprintf("drain handler[%s] of module[%s]", hd.name, hd.module))
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// routeTable snapshot of routes and modules, never modified after published.
+// writer copies it, modifies the copy and swaps the pointer(copy-on-write), so reader needs no lock.
+type routeTable struct {
+	handlers map[int32]*handlerDefinition
+	modules  []Module // registration order
+}
+
+func (rt *routeTable) clone() *routeTable {
+	nrt := &routeTable{handlers: make(map[int32]*handlerDefinition, len(rt.handlers)), modules: append([]Module{}, rt.modules...)}
+	for route, hd := range rt.handlers {
+		nrt.handlers[route] = hd
+	}
+	return nrt
+}
+
+func (rt *routeTable) module(name string) (int, Module) {
+	for idx, m := range rt.modules {
+		if m.Name() == name {
+			return idx, m
+		}
+	}
+	return -1, nil
+}
+
+// remove module and its routes, returns removed routes
+func (rt *routeTable) remove(name string) []*handlerDefinition {
+	var removed []*handlerDefinition
+	if idx, _ := rt.module(name); idx >= 0 {
+		rt.modules = append(rt.modules[:idx], rt.modules[idx+1:]...)
+	}
+	for route, hd := range rt.handlers {
+		if hd.module == name {
+			removed = append(removed, hd)
+			delete(rt.handlers, route)
+		}
+	}
+	return removed
+}
+
 type handlerManager struct {
-	// can not use directly
-	_handlerMap map[int32]*handlerDefinition
+	lock      sync.Mutex                 // serialize writers of table
+	table     atomic.Pointer[routeTable] // can not use directly, use routes()
+	running   bool                       // modules started or starting
+	switching chan struct{}              // closed when modules started or stopped, nil if not starting or stopping
+	started   []Module                   // started modules in dependency order
+	servers   int                        // running servers using this router
+	bus       *EventBus
+	subs      map[string][]*Subscription // event subscriptions of module
+	dog       *watchdog
+	dogStop   context.CancelFunc
+	// panicPolicy nil means panics are only logged
+	panicPolicy atomic.Pointer[PanicPolicy]
+}
+
+func newHandlerManager(name string) *handlerManager {
+	hm := &handlerManager{bus: NewEventBus(name, 0), subs: map[string][]*Subscription{}, dog: newWatchdog(DefaultSlowHandlerThreshold)}
+	hm.table.Store(&routeTable{handlers: make(map[int32]*handlerDefinition, 1000)})
+	return hm
+}
+
+func (hm *handlerManager) routes() *routeTable {
+	return hm.table.Load()
 }
 
 func (hm *handlerManager) invokeHandler(ctx context.Context, c Channel, req *message.ProtocolMessage) {
 	hd := hm.findHandlerDefinition(req.GetRoute())
-	if hd == nil {
+	if hd == nil || !hd.acquire() {
 		logk.Error("handler definition not found for message code", zap.Int32("msgCode", req.GetRoute()))
+		sendErrorResponse(c, req, NewErrorf(ErrCodeRouteNotFound, "route %d not found", req.GetRoute()))
 		return
 	}
 	// find codec
 	_codec := findMessageCodec(c, req.Codec)
 	if _codec == nil {
+		hd.release()
 		logk.Error("message codec not found", zap.String("codec", req.GetCodec().String()))
-		_ = c.Close()
+		sendErrorResponse(c, req, NewErrorf(ErrCodeUnsupportedCodec, "codec %s not supported", req.GetCodec().String()))
 		return
 	}
 	in, buf := hd.newIn(), utilk.NewLinkBuffer(req.Payload)
-	defer func() {
+	done := func() {
 		hd.releaseIn(in)
 		_ = buf.Release()
-	}()
+		hd.release()
+	}
 	// decode message
 	if err := _codec.Decode(buf, in); err != nil {
-		// decode failed. close channel
-		logk.Error("decode message error. suspicious channel, close it.", zap.Error(err))
-		_ = c.Close()
-	} else if out0, out1 := hd.invoke(ctx, c, in); out0 != nil || out1 != nil {
+		// decode failed. tell client the request is bad
+		logk.Error("decode message error.", zap.Int32("route", req.GetRoute()), zap.Error(err))
+		sendErrorResponse(c, req, NewError(ErrCodeBadRequest, "bad request"))
+	} else if err = hd.validate(in); err != nil {
+		logk.Debug("invalid request", zap.Int32("route", req.GetRoute()), zap.Int32("seq", req.GetSeq()), zap.Error(err))
+		sendErrorResponse(c, req, err)
+	} else if w := hd.dispatchWorker(ctx, c, req, in); w != nil {
+		// req is recycled after returned, channel is not pooled until handler finished
+		dc, clone := c.(*defaultChannel), proto.Clone(req).(*message.ProtocolMessage)
+		dc.retain()
+		if err = w.TryRun(ctx, func() {
+			defer dc.release()
+			defer done()
+			hm.respond(ctx, hd, c, clone, _codec, in)
+		}); err == nil {
+			return
+		}
+		dc.release()
+		_ = dc.onOverflow(req)
+	} else {
+		hm.respond(ctx, hd, c, req, _codec, in)
+	}
+	done()
+}
+
+// respond call handler with decoded request and send its outs to channel
+func (hm *handlerManager) respond(ctx context.Context, hd *handlerDefinition, c Channel, req *message.ProtocolMessage, _codec codec.Codec, in interface{}) {
+	if out0, out1, err := hm.call(ctx, hd, c, req, in); err != nil {
+		atomic.AddInt64(&hd.metrics.failed, 1)
+		var pe *panicError
+		if !errors.As(err, &pe) {
+			logk.Error("handler returned error", zap.Int32("route", req.GetRoute()), zap.Int32("seq", req.GetSeq()), zap.Error(err))
+		}
+		sendErrorResponse(c, req, err)
+		if pe != nil && pe.closeChannel {
+			logk.Warn("close channel caused too many panics", zap.Int("channel", c.GetFd()))
+			_ = c.Close()
+		}
+	} else if out0 != nil || out1 != nil {
 		res := req
-		if hd.outType == HandlerOutTypeProtoMessage {
-			res.Route = int32(out0.(int))
-			res.Payload, err = proto.Marshal(out1.(proto.Message))
+		if hd.outType == HandlerOutTypeProtoMessage || hd.outType == HandlerOutTypeObject {
+			// respond with the codec client used, unless route overrides it
+			outCodec, oc := _codec, req.GetCodec()
+			if hd.outCodec != nil && *hd.outCodec != oc {
+				if oc, outCodec = *hd.outCodec, findMessageCodec(c, *hd.outCodec); outCodec == nil {
+					logk.Errorf("response codec of route not found. route = %d, codec = %s", hd.messageCode, oc.String())
+					sendErrorResponse(c, req, NewErrorf(ErrCodeUnsupportedCodec, "codec %s not supported", oc.String()))
+					return
+				}
+			}
+			payload, err := outCodec.Encode(out1)
 			if err != nil {
 				logk.Errorf("encode handler response error. route = %d, err = %v", hd.messageCode, err)
+				sendErrorResponse(c, req, err)
 				return
 			}
+			res.Route, res.Codec, res.Payload = int32(out0.(int)), oc, payload
 		} else if hd.outType == HandlerOutTypeByteSlice {
 			res.Route = int32(out0.(int))
 			res.Payload = out1.([]byte)
@@ -104,6 +303,7 @@ func (hm *handlerManager) invokeHandler(ctx context.Context, c Channel, req *mes
 			return
 		}
 		//
+		stampReply(req, res)
 		if err = c.Send(res); err != nil { // send response
 			logk.Errorf("send response error: %v", err)
 		}
@@ -112,27 +312,314 @@ func (hm *handlerManager) invokeHandler(ctx context.Context, c Channel, req *mes
 	}
 }
 
+// call invoke handler with deadline of route, watched by watchdog
+func (hm *handlerManager) call(ctx context.Context, hd *handlerDefinition, c Channel, req *message.ProtocolMessage, in interface{}) (out0 interface{}, out1 interface{}, err error) {
+	ctx = hm.handlerContext(ctx, req)
+	if hd.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hd.timeout)
+		defer cancel()
+	}
+	// deadline of caller
+	if ms, err := strconv.ParseInt(req.GetHeader()[HeaderDeadline], 10, 64); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(ms))
+		defer cancel()
+	}
+	id, ts := hm.dog.begin(hd, c.GetFd(), req.GetSeq()), time.Now()
+	defer func() {
+		hd.metrics.observe(time.Since(ts))
+		hm.dog.end(id)
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			err = hm.onPanic(p, hd, c, req, in)
+		}
+	}()
+	return hd.handle(ctx, c, in)
+}
+
+func (hm *handlerManager) handlerContext(ctx context.Context, req *message.ProtocolMessage) context.Context {
+	return context.WithValue(context.WithValue(ctx, CtxKeyRoute, req.GetRoute()), CtxKeyEventBus, hm.bus)
+}
+
 func (hm *handlerManager) findHandlerDefinition(msgCode int32) *handlerDefinition {
-	return hm._handlerMap[msgCode]
+	return hm.routes().handlers[msgCode]
+}
+
+// registerModule add module and its routes, duplicated module or route is ignored with a warning
+func (hm *handlerManager) registerModule(module Module, defs []*handlerDefinition) error {
+	exists := func(rt *routeTable) error {
+		if idx, _ := rt.module(module.Name()); idx >= 0 {
+			return errModuleExists
+		}
+		return nil
+	}
+	err := hm.startThenApply(context.Background(), module, exists, func() error {
+		rt := hm.routes().clone()
+		if err := exists(rt); err != nil {
+			return err
+		}
+		for _, def := range defs {
+			if _, ok := rt.handlers[int32(def.messageCode)]; ok {
+				logk.Warnf("handler for message code [%d] already exists", def.messageCode)
+			} else {
+				logk.Debugf("register a new method handler for message code: %d", def.messageCode)
+				def.initInPool()
+				rt.handlers[int32(def.messageCode)] = def
+			}
+		}
+		rt.modules = append(rt.modules, module)
+		hm.table.Store(rt)
+		hm.listenModuleEvents(module)
+		return nil
+	})
+	if errors.Is(err, errModuleExists) {
+		logk.Warnf("module [%s] already exists", module.Name())
+		return nil
+	}
+	return err
+}
+
+func (hm *handlerManager) unregisterModule(ctx context.Context, name string) error {
+	hm.lock.Lock()
+	rt := hm.routes().clone()
+	_, module := rt.module(name)
+	if module == nil {
+		hm.lock.Unlock()
+		return fmt.Errorf("module [%s] not registered", name)
+	}
+	removed := rt.remove(name)
+	hm.table.Store(rt)
+	hm.unlistenModuleEvents(module)
+	started := hm.removeStarted(name)
+	hm.lock.Unlock()
+	//
+	logk.Info("module unregistered, drain handlers", zap.String("module", name), zap.Int("routes", len(removed)))
+	if err := hm.retire(ctx, module, removed, started); err != nil {
+		return errors.WithMessagef(err, "module [%s] unregistered, but drain of its handlers not finished", name)
+	}
+	return nil
+}
+
+func (hm *handlerManager) replaceModule(ctx context.Context, module Module, defs []*handlerDefinition) error {
+	var old Module
+	var removed []*handlerDefinition
+	var started bool
+	registered := func(rt *routeTable) error {
+		if _, m := rt.module(module.Name()); m == nil {
+			return fmt.Errorf("module [%s] not registered", module.Name())
+		}
+		return nil
+	}
+	// new module must be ready before it receives message
+	err := hm.startThenApply(ctx, module, registered, func() error {
+		rt := hm.routes().clone()
+		if err := registered(rt); err != nil {
+			return err
+		}
+		_, old = rt.module(module.Name())
+		removed = rt.remove(module.Name())
+		for _, def := range defs {
+			if _, ok := rt.handlers[int32(def.messageCode)]; ok {
+				return fmt.Errorf("handler for message code [%d] already exists in other module", def.messageCode)
+			}
+			def.initInPool()
+			rt.handlers[int32(def.messageCode)] = def
+		}
+		started = hm.removeStarted(module.Name())
+		rt.modules = append(rt.modules, module)
+		hm.table.Store(rt)
+		hm.unlistenModuleEvents(old)
+		hm.listenModuleEvents(module)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//
+	logk.Info("module replaced, drain old handlers", zap.String("module", module.Name()), zap.Int("routes", len(removed)))
+	if err = hm.retire(ctx, old, removed, started); err != nil {
+		return errors.WithMessagef(err, "module [%s] replaced, but drain of old handlers not finished", module.Name())
+	}
+	return nil
+}
+
+// errModuleExists module of the same name already registered
+var errModuleExists = errors.New("module already exists")
+
+// startThenApply start module when router is running, then apply change of routes under lock.
+// check runs under lock before module started, dependencies of module must be registered as well when running.
+// OnStart of module runs without lock since it may touch router, e.g. register other modules.
+// module is stopped if apply failed, and started again if running state changed meanwhile.
+func (hm *handlerManager) startThenApply(ctx context.Context, module Module, check func(rt *routeTable) error, apply func() error) error {
+	ctx = context.WithValue(ctx, CtxKeyEventBus, hm.bus)
+	for {
+		hm.lock.Lock()
+		running, rt := hm.running, hm.routes()
+		err := check(rt)
+		if err == nil && running {
+			err = checkDependencies(module, rt.modules)
+		}
+		hm.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if running {
+			if err := startModule(ctx, module); err != nil {
+				return err
+			}
+		}
+		hm.lock.Lock()
+		if hm.running != running {
+			hm.lock.Unlock()
+		} else {
+			err := apply()
+			if err == nil && running {
+				hm.started = append(hm.started, module)
+			}
+			hm.lock.Unlock()
+			if err != nil && running {
+				stopModules(ctx, []Module{module})
+			}
+			return err
+		}
+		if running {
+			stopModules(ctx, []Module{module})
+		}
+	}
 }
 
-func (hm *handlerManager) addHandlerDefinition(def *handlerDefinition) {
-	if _, ok := hm._handlerMap[int32(def.messageCode)]; ok {
-		logk.Warnf("handler for message code [%d] already exists", def.messageCode)
+// removeStarted remove module from started modules, returns true if it was started. must hold lock
+func (hm *handlerManager) removeStarted(name string) bool {
+	for idx, m := range hm.started {
+		if m.Name() == name {
+			hm.started = append(hm.started[:idx:idx], hm.started[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// retire drain removed routes of module, then stop it if it was started.
+// module is stopped even if drain not finished in time, with a grace period if ctx already done.
+func (hm *handlerManager) retire(ctx context.Context, module Module, removed []*handlerDefinition, started bool) error {
+	var errs []error
+	for _, hd := range removed {
+		if err := hd.drain(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if started {
+		stopCtx, cancel := graceContext(ctx)
+		defer cancel()
+		stopModules(stopCtx, []Module{module})
+	}
+	return stderrors.Join(errs...)
+}
+
+// start init and start all registered modules in dependency order, only the first server starts them.
+// hooks of modules run without lock since they may touch router, e.g. register other modules.
+func (hm *handlerManager) start(ctx context.Context) error {
+	hm.lock.Lock()
+	hm.waitSwitched()
+	if hm.servers++; hm.running {
+		hm.lock.Unlock()
+		return nil
+	}
+	// modules registered while starting are started by registration, see startThenApply
+	hm.running, hm.switching = true, make(chan struct{})
+	modules := hm.routes().modules
+	hm.lock.Unlock()
+	booted, err := startModules(context.WithValue(ctx, CtxKeyEventBus, hm.bus), modules)
+	hm.lock.Lock()
+	var stopping []Module
+	if err != nil {
+		// modules registered meanwhile
+		hm.servers--
+		stopping, hm.started, hm.running = hm.started, nil, false
 	} else {
-		logk.Debugf("register a new method handler for message code: %d", def.messageCode)
-		def.inPool = &sync.Pool{
-			New: func(hd *handlerDefinition) func() interface{} {
-				return func() interface{} {
-					in := hd.inType
-					if in.Kind() == reflect.Ptr {
-						in = in.Elem()
-					}
-					return reflect.New(in).Interface()
-				}
-			}(def),
+		// modules unregistered or replaced meanwhile are not in route table any more
+		present, kept := hm.routes().modules, make([]Module, 0, len(booted)+len(hm.started))
+		for _, m := range booted {
+			if slices.Contains(present, m) {
+				kept = append(kept, m)
+			} else {
+				stopping = append(stopping, m)
+			}
+		}
+		hm.started = append(kept, hm.started...)
+		var dogCtx context.Context
+		dogCtx, hm.dogStop = context.WithCancel(context.Background())
+		go hm.dog.run(dogCtx)
+	}
+	hm.switched()
+	stopModules(ctx, stopping)
+	return err
+}
+
+// stop all started modules in reverse dependency order when the last server stopped
+func (hm *handlerManager) stop(ctx context.Context) {
+	hm.lock.Lock()
+	hm.waitSwitched()
+	if hm.servers--; !hm.running || hm.servers > 0 {
+		hm.lock.Unlock()
+		return
+	}
+	hm.dogStop()
+	started := hm.started
+	hm.started, hm.running, hm.switching = nil, false, make(chan struct{})
+	hm.lock.Unlock()
+	stopModules(ctx, started)
+	hm.lock.Lock()
+	hm.switched()
+}
+
+// waitSwitched wait until modules started or stopped by other server, must hold lock
+func (hm *handlerManager) waitSwitched() {
+	for hm.switching != nil {
+		switching := hm.switching
+		hm.lock.Unlock()
+		<-switching
+		hm.lock.Lock()
+	}
+}
+
+// switched wake up servers waiting for start or stop, then release lock
+func (hm *handlerManager) switched() {
+	close(hm.switching)
+	hm.switching = nil
+	hm.lock.Unlock()
+}
+
+// listenModuleEvents must hold lock
+func (hm *handlerManager) listenModuleEvents(module Module) {
+	for _, e := range module.Events() {
+		event.Listen(e, module)
+	}
+	if es, ok := module.(EventSubscriber); ok {
+		hm.subs[module.Name()] = es.SubscribeEvents(hm.bus)
+	}
+}
+
+// unlistenModuleEvents must hold lock
+func (hm *handlerManager) unlistenModuleEvents(module Module) {
+	for _, e := range module.Events() {
+		event.Std().RemoveListener(e, module)
+	}
+	for _, sub := range hm.subs[module.Name()] {
+		sub.Cancel()
+	}
+	delete(hm.subs, module.Name())
+}
+
+// stampReply make response of request forwarded by gate route back to the client
+func stampReply(req, res *message.ProtocolMessage) {
+	if from, ok := req.GetHeader()[HeaderFromClient]; ok {
+		if res.Header == nil {
+			res.Header = map[string]string{}
 		}
-		hm._handlerMap[int32(def.messageCode)] = def
+		res.Header[HeaderToClient] = from
 	}
 }
 
@@ -149,8 +636,11 @@ func findMessageCodec(sc Channel, mc message.Codec) codec.Codec {
 		return nil
 	case message.Codec_FAST_PB:
 		return codec.Fastpb()
-	case message.Codec_SERVER:
-		return sc.(*defaultChannel).codec
+	case message.Codec_SERVER: // codec of channel, unknown without one, e.g. response of rpc
+		if dc, ok := sc.(*defaultChannel); ok {
+			return dc.codec
+		}
+		return nil
 	default:
 		return nil
 	}
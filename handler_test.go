@@ -1,13 +1,65 @@
 package smart
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"gitee.com/ywengineer/smart-kit/pkg/utilk"
 	"gitee.com/ywengineer/smart/codec"
 	"gitee.com/ywengineer/smart/message"
+	"gitee.com/ywengineer/smart/pkg"
+	"github.com/gookit/event"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+type mockChannel struct {
+	ctx  context.Context
+	sent []*message.ProtocolMessage
+}
+
+func (m *mockChannel) Context() context.Context             { return m.ctx }
+func (m *mockChannel) LaterRun(task func())                 { task() }
+func (m *mockChannel) Close() error                         { return nil }
+func (m *mockChannel) GetFd() int                           { return 1 }
+func (m *mockChannel) SetAttachment(attachment interface{}) {}
+func (m *mockChannel) GetAttachment() interface{}           { return nil }
+func (m *mockChannel) Schedule(delay time.Duration, task func()) *Timer {
+	return defaultTimerWheel.AfterFunc(delay, func() { m.LaterRun(task) })
+}
+func (m *mockChannel) ScheduleAtFixedRate(delay, period time.Duration, task func()) *Timer {
+	return defaultTimerWheel.Every(delay, period, func() { m.LaterRun(task) })
+}
+func (m *mockChannel) Send(msg interface{}) error {
+	m.sent = append(m.sent, proto.Clone(msg.(*message.ProtocolMessage)).(*message.ProtocolMessage))
+	return nil
+}
+
+func TestHandlerErrorResponse(t *testing.T) {
+	_ = RegisterModule(&TestModule{})
+	c := &mockChannel{ctx: context.Background()}
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 7, Route: 1006, Codec: message.Codec_JSON, Payload: []byte(`{"ping":1}`)})
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 8, Route: 1006, Codec: message.Codec_JSON, Payload: []byte(`{"ping":`)})
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 9, Route: 1006, Codec: message.Codec_JSON, Payload: []byte(`{"ping":100}`)})
+	assert.Len(t, c.sent, 3)
+	// business error
+	assert.Equal(t, RouteError, c.sent[0].Route)
+	assert.Equal(t, int32(7), c.sent[0].Seq)
+	assert.Equal(t, "1006", c.sent[0].Header[HeaderRoute])
+	assert.JSONEq(t, `{"code":1,"message":"not enough gold"}`, string(c.sent[0].Payload))
+	// decode error
+	assert.Equal(t, RouteError, c.sent[1].Route)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeBadRequest)), c.sent[1].Header[HeaderErrorCode])
+	// success
+	assert.Equal(t, int32(1007), c.sent[2].Route)
+	assert.Equal(t, int32(9), c.sent[2].Seq)
+}
+
 func TestPBCodec(t *testing.T) {
 	p := sync.Pool{
 		New: func() interface{} {
@@ -53,3 +105,435 @@ func TestJSONCodec(t *testing.T) {
 	_ = buf.Release()
 	t.Logf("%p = %v", req, req)
 }
+
+func TestHandlerResponseCodec(t *testing.T) {
+	_ = RegisterModule(&TestModule{})
+	c := &mockChannel{ctx: context.Background()}
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 1, Route: 1008, Codec: message.Codec_JSON, Payload: []byte(`{"ping":3}`)})
+	payload, _ := codec.Msgpack().Encode(&Req{Ping: 4})
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 2, Route: 1008, Codec: message.Codec_MSGPACK, Payload: payload})
+	assert.Len(t, c.sent, 2)
+	assert.Equal(t, message.Codec_JSON, c.sent[0].Codec)
+	assert.JSONEq(t, `{"pong":3}`, string(c.sent[0].Payload))
+	res := &Res{}
+	assert.Equal(t, message.Codec_MSGPACK, c.sent[1].Codec)
+	assert.Nil(t, codec.Msgpack().Decode(utilk.NewLinkBuffer(c.sent[1].Payload), res))
+	assert.Equal(t, 4, res.Pong)
+}
+
+type middlewareModule struct {
+}
+
+func (m *middlewareModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *middlewareModule) Name() string {
+	return "middlewareModule"
+}
+
+func (m *middlewareModule) Events() []string {
+	return nil
+}
+
+func (m *middlewareModule) Echo2001(ctx context.Context, channel Channel, req *Req) (int, *Res) {
+	return 2001, &Res{Pong: req.Ping}
+}
+
+func (m *middlewareModule) Admin2002(ctx context.Context, channel Channel, req *Req) (int, *Res) {
+	return 2002, &Res{Pong: req.Ping}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+				trace = append(trace, name+strconv.Itoa(int(routeOf(ctx))))
+				return next(ctx, channel, in)
+			}
+		}
+	}
+	err := RegisterModule(&middlewareModule{},
+		WithMiddleware(tracer("module")),
+		WithRouteMiddleware(2002, tracer("route"), AdminOnly(func(ctx context.Context, channel Channel) bool { return false })),
+	)
+	assert.Nil(t, err)
+	c := &mockChannel{ctx: context.Background()}
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 1, Route: 2001, Codec: message.Codec_JSON, Payload: []byte(`{"ping":1}`)})
+	hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 2, Route: 2002, Codec: message.Codec_JSON, Payload: []byte(`{"ping":2}`)})
+	assert.Equal(t, []string{"module2001", "module2002", "route2002"}, trace)
+	assert.Len(t, c.sent, 2)
+	assert.Equal(t, int32(2001), c.sent[0].Route)
+	assert.Equal(t, RouteError, c.sent[1].Route)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeForbidden)), c.sent[1].Header[HeaderErrorCode])
+}
+
+func TestRateLimit(t *testing.T) {
+	rl := &rateLimiter{n: 2, window: 50 * time.Millisecond}
+	link := &defaultChannel{ctx: context.Background(), fd: 7}
+	gateLinks.Store(link, struct{}{}) // as if initialized by Pusher.TrustedInitializer
+	defer gateLinks.Delete(link)
+	viaGate := func(client, user string) context.Context {
+		header := map[string]string{HeaderFromClient: client}
+		if len(user) > 0 {
+			header[HeaderUserId] = user
+		}
+		return context.WithValue(context.Background(), CtxKeyHeader, header)
+	}
+	// windowsOf number of windows of channel, sweeper runs meanwhile
+	windowsOf := func(fd int) (int, bool) {
+		v, ok := rl.channels.Load(fd)
+		if !ok {
+			return 0, false
+		}
+		cr := v.(*channelRates)
+		cr.lock.Lock()
+		defer cr.lock.Unlock()
+		return len(cr.windows), true
+	}
+	// players behind one link of gate have their own windows
+	for _, ctx := range []context.Context{viaGate("1", ""), viaGate("2", ""), viaGate("3", "u1")} {
+		assert.True(t, rl.allow(ctx, link))
+		assert.True(t, rl.allow(ctx, link))
+		assert.False(t, rl.allow(ctx, link))
+	}
+	// user is limited across client connections
+	assert.False(t, rl.allow(viaGate("4", "u1"), link))
+	assert.True(t, rl.allow(context.Background(), link))
+	// headers of channel not linking gate are ignored
+	direct := &defaultChannel{ctx: context.Background(), fd: 8}
+	assert.True(t, rl.allow(viaGate("1", "u2"), direct))
+	assert.True(t, rl.allow(viaGate("2", "u3"), direct))
+	assert.False(t, rl.allow(viaGate("3", "u4"), direct))
+	windows, _ := windowsOf(8)
+	assert.Equal(t, 1, windows)
+	// expired windows are swept
+	mock := &mockChannel{ctx: context.Background()}
+	assert.True(t, rl.allow(context.Background(), mock))
+	time.Sleep(60 * time.Millisecond)
+	rl.sweep()
+	windows, ok := windowsOf(7)
+	assert.True(t, ok)
+	assert.Zero(t, windows)
+	_, ok = windowsOf(mock.GetFd())
+	assert.False(t, ok, "idle channel without close hook is dropped")
+	// windows of closed channel are dropped, new channel with same fd starts over
+	assert.True(t, rl.allow(context.Background(), link))
+	assert.True(t, rl.allow(context.Background(), link))
+	link.onClose()
+	direct.onClose()
+	_, ok = windowsOf(7)
+	assert.False(t, ok)
+	// sweeper stopped once no channel left
+	sweeping := func() bool {
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+		return rl.sweeper != nil
+	}
+	rl.sweep()
+	assert.False(t, sweeping())
+	reused := &defaultChannel{ctx: context.Background(), fd: 7}
+	assert.True(t, rl.allow(context.Background(), reused))
+	assert.True(t, sweeping())
+	reused.onClose()
+	//
+	c := &mockChannel{ctx: context.Background()}
+	handler := RateLimit(1, time.Minute)(func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+		return nil, nil, nil
+	})
+	_, _, err := handler(c.ctx, c, nil)
+	assert.Nil(t, err)
+	_, _, err = handler(c.ctx, c, nil)
+	assert.Equal(t, ErrCodeTooManyRequests, err.(*Error).Code)
+}
+
+type codecModule struct {
+	codecs map[int]message.Codec
+}
+
+func (m *codecModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *codecModule) Events() []string {
+	return nil
+}
+
+func (m *codecModule) Name() string {
+	return "codecModule"
+}
+
+func (m *codecModule) ResponseCodecs() map[int]message.Codec {
+	return m.codecs
+}
+
+func (m *codecModule) Query4201(ctx context.Context, channel Channel, req *Req) (int, *Res) {
+	return 4201, &Res{Pong: req.Ping}
+}
+
+func TestResponseCodec(t *testing.T) {
+	r := NewRouter().(*handlerManager)
+	assert.ErrorContains(t, r.RegisterModule(&codecModule{codecs: map[int]message.Codec{4201: message.Codec_THRIFT}}), "not supported")
+	// codec of channel is unknown without one
+	assert.Nil(t, r.RegisterModule(&codecModule{codecs: map[int]message.Codec{4201: message.Codec_SERVER}}))
+	c := &mockChannel{ctx: context.Background()}
+	r.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: 1, Route: 4201, Codec: message.Codec_JSON, Payload: []byte(`{"ping":1}`)})
+	if assert.Len(t, c.sent, 1) {
+		assert.Equal(t, RouteError, c.sent[0].Route)
+		assert.Equal(t, int32(1), c.sent[0].Seq)
+		assert.Equal(t, strconv.Itoa(int(ErrCodeUnsupportedCodec)), c.sent[0].Header[HeaderErrorCode])
+	}
+}
+
+type createRoleReq struct {
+	Name  string `json:"name" validate:"required,maxlen=8"`
+	Level int    `json:"level" validate:"min=1,max=99"`
+	Job   int    `json:"job"`
+}
+
+func (r *createRoleReq) Validate() error {
+	if r.Job == 3 {
+		return errors.New("job is locked")
+	}
+	return nil
+}
+
+func (m *middlewareModule) CreateRole2003(ctx context.Context, channel Channel, req *createRoleReq) (int, *Res) {
+	return 2003, &Res{Pong: req.Level}
+}
+
+func TestHandlerValidation(t *testing.T) {
+	assert.Nil(t, RegisterModule(&middlewareModule{}))
+	c := &mockChannel{ctx: context.Background()}
+	for idx, payload := range []string{
+		`{"name":"", "level":1}`,
+		`{"name":"too long name", "level":1}`,
+		`{"name":"smart", "level":100}`,
+		`{"name":"smart", "level":1, "job": 3}`,
+		`{"name":"smart", "level":1}`,
+	} {
+		hManager.invokeHandler(c.ctx, c, &message.ProtocolMessage{Seq: int32(idx), Route: 2003, Codec: message.Codec_JSON, Payload: []byte(payload)})
+	}
+	assert.Len(t, c.sent, 5)
+	for _, res := range c.sent[:4] {
+		assert.Equal(t, RouteError, res.Route)
+		assert.Equal(t, strconv.Itoa(int(ErrCodeInvalidRequest)), res.Header[HeaderErrorCode])
+	}
+	assert.JSONEq(t, `{"code":422,"message":"name is required"}`, string(c.sent[0].Payload))
+	assert.JSONEq(t, `{"code":422,"message":"job is locked"}`, string(c.sent[3].Payload))
+	assert.Equal(t, int32(2003), c.sent[4].Route)
+	var metrics *RouteMetrics
+	for _, m := range GetRouteMetrics() {
+		if m.Route == 2003 {
+			metrics = &m
+		}
+	}
+	if assert.NotNil(t, metrics, "metrics of route 2003") {
+		assert.Equal(t, int64(4), metrics.Invalid)
+		assert.Equal(t, int64(1), metrics.Invoked)
+	}
+}
+
+type slowModule struct {
+	block chan struct{}
+}
+
+func (m *slowModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *slowModule) Events() []string {
+	return nil
+}
+
+func (m *slowModule) Name() string {
+	return "slowModule"
+}
+
+func (m *slowModule) Slow4001(ctx context.Context, channel Channel, req *Req) error {
+	select {
+	case <-m.block:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSlowHandler(t *testing.T) {
+	r := NewRouter().(*handlerManager)
+	r.SetSlowHandlerThreshold(20 * time.Millisecond)
+	m := &slowModule{block: make(chan struct{})}
+	assert.Nil(t, r.RegisterModule(m, WithTimeout(time.Hour), WithRouteTimeout(4001, 100*time.Millisecond)))
+	c := &mockChannel{ctx: context.Background()}
+	done := make(chan struct{})
+	go func() {
+		r.invokeHandler(c.ctx, c, &message.ProtocolMessage{Route: 4001, Codec: message.Codec_JSON, Payload: []byte(`{}`)})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, handlerStacks(goroutineStacks(), "Slow4001"), 1)
+	r.dog.check()
+	r.dog.running.Range(func(key, value interface{}) bool {
+		assert.Equal(t, int32(1), value.(*invocation).reported)
+		return true
+	})
+	<-done
+	// deadline of route exceeded, it wins over the one of module
+	assert.Equal(t, strconv.Itoa(int(ErrCodeTimeout)), c.sent[0].Header[HeaderErrorCode])
+	latency := r.Metrics()[0].Latency
+	assert.Equal(t, int64(1), latency.Counts[5])
+	assert.True(t, latency.Max >= 100*time.Millisecond)
+}
+
+type roomModule struct {
+	running, overlapped, count int32
+}
+
+func (m *roomModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *roomModule) Name() string {
+	return "roomModule"
+}
+
+func (m *roomModule) Events() []string {
+	return nil
+}
+
+func (m *roomModule) EnterRoom6001(ctx context.Context, channel Channel, req *Req) {
+	if !atomic.CompareAndSwapInt32(&m.running, 0, 1) {
+		atomic.AddInt32(&m.overlapped, 1)
+	} else {
+		time.Sleep(time.Millisecond)
+		atomic.StoreInt32(&m.running, 0)
+	}
+	atomic.AddInt32(&m.count, 1)
+}
+
+func TestDispatchKey(t *testing.T) {
+	m, r := &roomModule{}, NewRouter()
+	assert.Nil(t, r.RegisterModule(m, WithDispatchKey(6001, KeyFromField("Extra"))))
+	wm := NewWorkerManager(4, RoundRobin)
+	assert.Equal(t, wm.PickKey("room-1"), wm.PickKey("room-1"))
+	// players of the same room on different workers
+	for i := 0; i < 4; i++ {
+		dc := &defaultChannel{ctx: context.Background(), worker: wm.Pick(i), workers: wm, router: r.(*handlerManager)}
+		for j := 0; j < 10; j++ {
+			dc.worker.Run(dc.ctx, func() {
+				r.(*handlerManager).invokeHandler(dc.ctx, dc, &message.ProtocolMessage{Route: 6001, Codec: message.Codec_JSON, Payload: []byte(`{"extra":"room-1"}`)})
+			})
+		}
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&m.count) == 40 }, 2*time.Second, 10*time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&m.overlapped))
+}
+
+func TestDispatchRetainChannel(t *testing.T) {
+	m, r := &roomModule{}, NewRouter()
+	assert.Nil(t, r.RegisterModule(m, WithDispatchKey(6001, KeyFromField("Extra"))))
+	wm := NewWorkerManager(2, RoundRobin)
+	room := wm.PickKey("room-1")
+	dc := &defaultChannel{ctx: context.Background(), worker: wm.Pick(0), workers: wm, router: r.(*handlerManager), handlers: []ChannelHandler{NewPusher(nil)}}
+	if dc.worker == room {
+		dc.worker = wm.Pick(1)
+	}
+	// worker of room busy
+	block := make(chan struct{})
+	room.Run(dc.ctx, func() { <-block })
+	r.(*handlerManager).invokeHandler(dc.ctx, dc, &message.ProtocolMessage{Route: 6001, Codec: message.Codec_JSON, Payload: []byte(`{"extra":"room-1"}`)})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dc.refs))
+	// closed while invocation pending, not pooled until it finished
+	dc.onClose()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dc.refs) == 0 }, time.Second, time.Millisecond)
+	close(block)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dc.refs) == -1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.count))
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	m, r := &roomModule{}, NewRouter()
+	assert.Nil(t, r.RegisterModule(m, WithDispatchKey(6001, KeyFromField("Extra"))))
+	wm := NewWorkerManager(2, RoundRobin)
+	wm.SetQueueLimit(1, OverflowClose)
+	room, conn := wm.PickKey("room-1"), &closeConn{}
+	dc := &defaultChannel{ctx: context.Background(), conn: conn, fd: conn.Fd(), codec: codec.NewSmartCodec(binary.LittleEndian), worker: wm.Pick(0), workers: wm, router: r.(*handlerManager)}
+	if dc.worker == room {
+		dc.worker = wm.Pick(1)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	assert.Nil(t, room.TryRun(dc.ctx, func() { <-block }))
+	// queue of room full, channel closed by policy
+	r.(*handlerManager).invokeHandler(dc.ctx, dc, &message.ProtocolMessage{Route: 6001, Codec: message.Codec_JSON, Payload: []byte(`{"extra":"room-1"}`)})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conn.closed))
+	assert.Zero(t, atomic.LoadInt32(&dc.refs))
+	assert.Equal(t, 1, room.Pending())
+}
+
+type panicModule struct{}
+
+func (m *panicModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *panicModule) Name() string {
+	return "panicModule"
+}
+
+func (m *panicModule) Events() []string {
+	return nil
+}
+
+func (m *panicModule) Boom6101(ctx context.Context, channel Channel, req *Req) (int, *Req) {
+	panic("boom")
+}
+
+// closeConn pkg.Conn records writes and close
+type closeConn struct {
+	written int32
+	closed  int32
+}
+
+func (c *closeConn) Reader() pkg.Reader { return nil }
+func (c *closeConn) Writer() pkg.Writer { return c }
+func (c *closeConn) Close() error       { atomic.StoreInt32(&c.closed, 1); return nil }
+func (c *closeConn) Fd() int            { return 2 }
+func (c *closeConn) Flush() error       { return nil }
+func (c *closeConn) WriteBinary(b []byte) (int, error) {
+	atomic.AddInt32(&c.written, 1)
+	return len(b), nil
+}
+
+func TestPanicPolicy(t *testing.T) {
+	r := NewRouter()
+	assert.Nil(t, r.RegisterModule(&panicModule{}))
+	var panics []*HandlerPanic
+	r.SetPanicPolicy(PanicPolicy{CloseAfter: 2, OnPanic: func(p *HandlerPanic) {
+		panics = append(panics, p)
+	}})
+	conn := &closeConn{}
+	dc := &defaultChannel{ctx: context.Background(), conn: conn, fd: conn.Fd(), codec: codec.NewSmartCodec(binary.LittleEndian)}
+	req := func(seq int32) *message.ProtocolMessage {
+		return &message.ProtocolMessage{Seq: seq, Route: 6101, Codec: message.Codec_JSON, Payload: []byte(`{"ping":1}`)}
+	}
+	r.(*handlerManager).invokeHandler(dc.ctx, dc, req(1))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conn.written))
+	assert.Zero(t, atomic.LoadInt32(&conn.closed))
+	r.(*handlerManager).invokeHandler(dc.ctx, dc, req(2))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conn.written))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conn.closed))
+	assert.Len(t, panics, 2)
+	assert.Equal(t, "boom", panics[1].Value)
+	assert.Equal(t, int32(6101), panics[1].Route)
+	assert.Equal(t, int32(2), panics[1].Seq)
+	assert.Equal(t, 2, panics[1].Count)
+	assert.NotEmpty(t, panics[1].Stack)
+	// generic error response
+	c := &mockChannel{ctx: context.Background()}
+	r.(*handlerManager).invokeHandler(c.ctx, c, req(3))
+	assert.Len(t, c.sent, 1)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeInternal)), c.sent[0].Header[HeaderErrorCode])
+	assert.JSONEq(t, `{"code":500,"message":"internal server error"}`, string(c.sent[0].Payload))
+}
@@ -0,0 +1,65 @@
+package smart
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// defaultReplicas virtual nodes of a node with weight 1
+const defaultReplicas = 64
+
+// hashRing consistent hashing ring, keys map to the same node as long as the node exists.
+// not safe for concurrent modification, build a new one when nodes changed.
+type hashRing struct {
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func newHashRing() *hashRing {
+	return &hashRing{owners: map[uint64]string{}}
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	// fnv of similar keys is not well distributed, mix it
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// add node with weight, weight < 1 is treated as 1
+func (r *hashRing) add(node string, weight int) *hashRing {
+	if weight < 1 {
+		weight = 1
+	}
+	for i := 0; i < defaultReplicas*weight; i++ {
+		hash := hashKey(node + "#" + strconv.Itoa(i))
+		if _, ok := r.owners[hash]; !ok {
+			r.owners[hash] = node
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// get node of key, empty if ring is empty
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owners[r.hashes[idx]]
+}
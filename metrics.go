@@ -0,0 +1,112 @@
+package smart
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets upper bounds of latency histogram buckets, the last bucket(+Inf) is implicit
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// LatencyBuckets upper bounds of LatencyHistogram buckets
+func LatencyBuckets() []time.Duration {
+	return latencyBuckets[:]
+}
+
+// LatencyHistogram snapshot of handler latency, Counts[i] is the count of invocations <= LatencyBuckets()[i],
+// the last one is the count of slower ones.
+type LatencyHistogram struct {
+	Counts []int64       `json:"counts"`
+	Sum    time.Duration `json:"sum"`
+	Max    time.Duration `json:"max"`
+}
+
+// RouteMetrics snapshot of counters of a route
+type RouteMetrics struct {
+	Route   int32            `json:"route"`
+	Name    string           `json:"name"`
+	Invoked int64            `json:"invoked"` // handler invoked
+	Failed  int64            `json:"failed"`  // handler returned error
+	Invalid int64            `json:"invalid"` // request rejected by validation
+	Latency LatencyHistogram `json:"latency"`
+}
+
+// WorkerMetrics snapshot of counters of a worker
+type WorkerMetrics struct {
+	Name     string           `json:"name"`
+	Pending  int              `json:"pending"`  // tasks queued or running
+	Executed int64            `json:"executed"` // tasks finished
+	Rejected int64            `json:"rejected"` // tasks rejected since queue is full
+	Wait     LatencyHistogram `json:"wait"`     // time tasks waited in queue
+	Exec     LatencyHistogram `json:"exec"`     // time tasks ran
+}
+
+type routeMetrics struct {
+	invoked int64
+	failed  int64
+	invalid int64
+	latencyMetrics
+}
+
+type latencyMetrics struct {
+	buckets [len(latencyBuckets) + 1]int64
+	sum     int64
+	max     int64
+}
+
+func (rm *latencyMetrics) observe(cost time.Duration) {
+	idx := sort.Search(len(latencyBuckets), func(i int) bool {
+		return cost <= latencyBuckets[i]
+	})
+	atomic.AddInt64(&rm.buckets[idx], 1)
+	atomic.AddInt64(&rm.sum, int64(cost))
+	for m := atomic.LoadInt64(&rm.max); int64(cost) > m; m = atomic.LoadInt64(&rm.max) {
+		if atomic.CompareAndSwapInt64(&rm.max, m, int64(cost)) {
+			break
+		}
+	}
+}
+
+func (rm *routeMetrics) snapshot(hd *handlerDefinition) RouteMetrics {
+	return RouteMetrics{
+		Route:   int32(hd.messageCode),
+		Name:    hd.name,
+		Invoked: atomic.LoadInt64(&rm.invoked),
+		Failed:  atomic.LoadInt64(&rm.failed),
+		Invalid: atomic.LoadInt64(&rm.invalid),
+		Latency: rm.latency(),
+	}
+}
+
+func (rm *latencyMetrics) latency() LatencyHistogram {
+	h := LatencyHistogram{
+		Counts: make([]int64, len(rm.buckets)),
+		Sum:    time.Duration(atomic.LoadInt64(&rm.sum)),
+		Max:    time.Duration(atomic.LoadInt64(&rm.max)),
+	}
+	for idx := range rm.buckets {
+		h.Counts[idx] = atomic.LoadInt64(&rm.buckets[idx])
+	}
+	return h
+}
+
+// GetRouteMetrics returns metrics of all routes of DefaultRouter, ordered by route
+func GetRouteMetrics() []RouteMetrics {
+	return hManager.Metrics()
+}
+
+func (hm *handlerManager) Metrics() []RouteMetrics {
+	handlers := hm.routes().handlers
+	ms := make([]RouteMetrics, 0, len(handlers))
+	for _, hd := range handlers {
+		ms = append(ms, hd.metrics.snapshot(hd))
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Route < ms[j].Route
+	})
+	return ms
+}
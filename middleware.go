@@ -0,0 +1,264 @@
+package smart
+
+import (
+	"context"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sync"
+	"time"
+)
+
+// HandlerFunc invoke handler with decoded request(in), returns outs of handler and error.
+// route of current invocation can be got by CtxKeyRoute from context.Context
+type HandlerFunc func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error)
+
+// Middleware wraps handler invocation of route. return error without calling next to reject the request.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// ModuleOption option of RegisterModule
+type ModuleOption func(opts *moduleOptions)
+
+type moduleOptions struct {
+	middlewares      []Middleware
+	routeMiddlewares map[int][]Middleware
+	timeout          time.Duration
+	routeTimeouts    map[int]time.Duration
+	dispatchKeys     map[int]DispatchKey
+}
+
+func newModuleOptions(opts []ModuleOption) *moduleOptions {
+	mo := &moduleOptions{routeMiddlewares: map[int][]Middleware{}, routeTimeouts: map[int]time.Duration{}, dispatchKeys: map[int]DispatchKey{}}
+	for _, opt := range opts {
+		opt(mo)
+	}
+	return mo
+}
+
+// middlewaresOf module middlewares run before route middlewares, the first declared is the outermost one.
+func (mo *moduleOptions) middlewaresOf(route int) []Middleware {
+	mws := make([]Middleware, 0, len(mo.middlewares)+len(mo.routeMiddlewares[route]))
+	mws = append(mws, mo.middlewares...)
+	return append(mws, mo.routeMiddlewares[route]...)
+}
+
+// WithMiddleware apply middlewares to all routes of module
+func WithMiddleware(mws ...Middleware) ModuleOption {
+	return func(opts *moduleOptions) {
+		opts.middlewares = append(opts.middlewares, mws...)
+	}
+}
+
+// WithRouteMiddleware apply middlewares to route of module
+func WithRouteMiddleware(route int, mws ...Middleware) ModuleOption {
+	return func(opts *moduleOptions) {
+		opts.routeMiddlewares[route] = append(opts.routeMiddlewares[route], mws...)
+	}
+}
+
+// timeoutOf deadline budget of route, route timeout takes precedence over module timeout
+func (mo *moduleOptions) timeoutOf(route int) time.Duration {
+	if d, ok := mo.routeTimeouts[route]; ok {
+		return d
+	}
+	return mo.timeout
+}
+
+// WithTimeout deadline budget of context.Context of all routes in module.
+// it is the only deadline of handler besides the one of caller (HeaderDeadline), the earlier of them wins.
+// handler should watch ctx.Done(), returned context error is sent to client with ErrCodeTimeout
+func WithTimeout(d time.Duration) ModuleOption {
+	return func(opts *moduleOptions) {
+		opts.timeout = d
+	}
+}
+
+// WithRouteTimeout deadline budget of context.Context of route, it takes precedence over WithTimeout of module
+func WithRouteTimeout(route int, d time.Duration) ModuleOption {
+	return func(opts *moduleOptions) {
+		opts.routeTimeouts[route] = d
+	}
+}
+
+func chainMiddleware(h HandlerFunc, mws []Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+func routeOf(ctx context.Context) int32 {
+	route, _ := ctx.Value(CtxKeyRoute).(int32)
+	return route
+}
+
+// AuthRequired reject request with ErrCodeUnauthorized when authed returns false
+func AuthRequired(authed func(ctx context.Context, channel Channel) bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+			if !authed(ctx, channel) {
+				return nil, nil, NewError(ErrCodeUnauthorized, "unauthorized")
+			}
+			return next(ctx, channel, in)
+		}
+	}
+}
+
+// AdminOnly reject request with ErrCodeForbidden when isAdmin returns false
+func AdminOnly(isAdmin func(ctx context.Context, channel Channel) bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+			if !isAdmin(ctx, channel) {
+				return nil, nil, NewError(ErrCodeForbidden, "forbidden")
+			}
+			return next(ctx, channel, in)
+		}
+	}
+}
+
+// RateLimit allow at most n requests of each client in every window, exceeded request is rejected with ErrCodeTooManyRequests.
+// client is the user of HeaderUserId or the client connection of HeaderFromClient on links trusted to gates, see Pusher.TrustedInitializer,
+// so players behind a gate are limited one by one rather than by link of gate. client is the channel itself otherwise.
+// counters of channel are dropped once it closed, expired ones are swept every window while any channel is limited.
+func RateLimit(n int, window time.Duration) Middleware {
+	rl := &rateLimiter{n: n, window: window}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+			if !rl.allow(ctx, channel) {
+				return nil, nil, NewError(ErrCodeTooManyRequests, "too many requests")
+			}
+			return next(ctx, channel, in)
+		}
+	}
+}
+
+type rateLimiter struct {
+	n        int
+	window   time.Duration
+	channels sync.Map // key=fd, value=*channelRates
+	lock     sync.Mutex
+	sweeper  *Timer // nil if no channel limited
+}
+
+// channelRates windows of clients on a channel
+type channelRates struct {
+	lock     sync.Mutex
+	windows  map[string]*rateWindow // key=client, empty for channel itself
+	closable bool                   // dropped once channel closed, otherwise once idle
+	dropped  bool                   // removed from limiter
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func (rl *rateLimiter) allow(ctx context.Context, channel Channel) bool {
+	var client string
+	if header, ok := ctx.Value(CtxKeyHeader).(map[string]string); ok && trustedLink(channel) {
+		if uid := header[HeaderUserId]; len(uid) > 0 {
+			client = "user:" + uid
+		} else if from, ok := header[HeaderFromClient]; ok {
+			client = "client:" + from
+		}
+	}
+	cr := rl.ratesOf(channel)
+	defer cr.lock.Unlock()
+	w, ok := cr.windows[client]
+	if now := time.Now(); !ok || now.Sub(w.start) >= rl.window {
+		w = &rateWindow{start: now}
+		cr.windows[client] = w
+	}
+	w.count++
+	return w.count <= rl.n
+}
+
+// ratesOf returns locked windows of channel
+func (rl *rateLimiter) ratesOf(channel Channel) *channelRates {
+	fd := channel.GetFd()
+	for {
+		dc, closable := channel.(*defaultChannel)
+		v, loaded := rl.channels.LoadOrStore(fd, &channelRates{windows: map[string]*rateWindow{}, closable: closable})
+		cr := v.(*channelRates)
+		if !loaded {
+			rl.startSweeper()
+			if closable {
+				// fd may be taken by a new channel once closed
+				dc.whenClosed(func() { rl.drop(fd, cr) })
+			}
+		}
+		cr.lock.Lock()
+		if !cr.dropped {
+			return cr
+		}
+		cr.lock.Unlock()
+	}
+}
+
+func (rl *rateLimiter) drop(fd int, cr *channelRates) {
+	cr.lock.Lock()
+	cr.dropped = true
+	cr.lock.Unlock()
+	rl.channels.CompareAndDelete(fd, cr)
+}
+
+func (rl *rateLimiter) startSweeper() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.sweeper == nil {
+		rl.sweeper = defaultTimerWheel.Every(rl.window, rl.window, func() { go rl.sweep() })
+	}
+}
+
+// sweep drop expired windows, they would be reset by next request anyway. sweeper is stopped once no channel left
+func (rl *rateLimiter) sweep() {
+	now := time.Now()
+	rl.channels.Range(func(key, value interface{}) bool {
+		cr := value.(*channelRates)
+		cr.lock.Lock()
+		for client, w := range cr.windows {
+			if now.Sub(w.start) >= rl.window {
+				delete(cr.windows, client)
+			}
+		}
+		if len(cr.windows) == 0 && !cr.closable {
+			cr.dropped = true
+			rl.channels.CompareAndDelete(key, cr)
+		}
+		cr.lock.Unlock()
+		return true
+	})
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	empty := true
+	rl.channels.Range(func(key, value interface{}) bool {
+		empty = false
+		return false
+	})
+	if empty && rl.sweeper != nil {
+		rl.sweeper.Cancel()
+		rl.sweeper = nil
+	}
+}
+
+// Logging log every invocation of route with level
+func Logging(level zapcore.Level) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, channel Channel, in interface{}) (interface{}, interface{}, error) {
+			ts := time.Now()
+			out0, out1, err := next(ctx, channel, in)
+			fields := []zap.Field{zap.Int32("route", routeOf(ctx)), zap.Int("channel", channel.GetFd()), zap.Duration("cost", time.Since(ts)), zap.Error(err)}
+			switch level {
+			case zapcore.DebugLevel:
+				logk.Debug("handler invoked", fields...)
+			case zapcore.InfoLevel:
+				logk.Info("handler invoked", fields...)
+			case zapcore.WarnLevel:
+				logk.Warn("handler invoked", fields...)
+			default:
+				logk.Error("handler invoked", fields...)
+			}
+			return out0, out1, err
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package smart
 
 import (
+	"context"
 	"fmt"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/message"
 	"github.com/gookit/event"
 	"github.com/pkg/errors"
 	"github.com/samber/lo"
@@ -11,28 +13,65 @@ import (
 )
 
 // Module game logic module interface define
-// logic method signature MethodFormat[(MessageName:string)(MessageCode:int)](context.Context, Channel, *Any) [*ResponseType]
+// logic method signature MethodFormat[(MessageName:string)(MessageCode:int)](context.Context, Channel, *Any) [*ResponseType] [error]
+// (int, *ResponseType) is encoded with the codec of request, module can override it by implementing ResponseCodecs
+// a non-nil error is sent to client as an error response(RouteError), return *Error to control code and message
 // can get CtxKeySeq and CtxKeyHeader from logic method parameter context.Context
+// typed events: implement EventSubscriber to Subscribe, and Publish with the context of handler
 type Module interface {
 	event.Listener
 	Name() string
 	Events() []string
 }
 
-var exclusiveMethod = []string{"Name", "Events", "Handle"}
+// ResponseCodecs optional interface of Module, overrides response codec of routes(key is route).
+// response of route not in map is encoded with the codec of request.
+type ResponseCodecs interface {
+	ResponseCodecs() map[int]message.Codec
+}
+
+var exclusiveMethod = []string{"Name", "Events", "Handle", "ResponseCodecs", "OnInit", "OnStart", "OnStop", "DependsOn", "SubscribeEvents"}
 
 func isExclusiveMethod(method string) bool {
 	return lo.Contains(exclusiveMethod, method)
 }
 
-func RegisterModule(module Module) error {
+// RegisterModule register module to DefaultRouter, see Router.RegisterModule
+func RegisterModule(module Module, opts ...ModuleOption) error {
+	return hManager.RegisterModule(module, opts...)
+}
+
+// UnregisterModule unregister module from DefaultRouter, see Router.UnregisterModule
+func UnregisterModule(ctx context.Context, name string) error {
+	return hManager.UnregisterModule(ctx, name)
+}
+
+// ReplaceModule replace module of DefaultRouter, see Router.ReplaceModule
+func ReplaceModule(ctx context.Context, module Module, opts ...ModuleOption) error {
+	return hManager.ReplaceModule(ctx, module, opts...)
+}
+
+// newModuleHandlers generate handler definitions of module
+func newModuleHandlers(module Module, opts []ModuleOption) ([]*handlerDefinition, error) {
+	mOpts := newModuleOptions(opts)
 	mv := reflect.ValueOf(module)
 	if mv.Type().Kind() != reflect.Ptr {
-		return fmt.Errorf("module must be a ptr and implements Module")
+		return nil, fmt.Errorf("module must be a ptr and implements Module")
 	}
 	methods := mv.NumMethod()
 	if methods == 0 {
-		return fmt.Errorf("module[%s] has not any method exposed", mv.Type().Name())
+		return nil, fmt.Errorf("module[%s] has not any method exposed", mv.Type().Name())
+	}
+	var defs []*handlerDefinition
+	var outCodecs map[int]message.Codec
+	if rc, ok := module.(ResponseCodecs); ok {
+		outCodecs = rc.ResponseCodecs()
+	}
+	// codec of channel is known when responding only
+	for route, oc := range outCodecs {
+		if oc != message.Codec_SERVER && findMessageCodec(nil, oc) == nil {
+			return nil, fmt.Errorf("response codec [%s] of route [%d] in module[%s] not supported", oc.String(), route, module.Name())
+		}
 	}
 	// generate handler definition
 	for mIndex := 0; mIndex < methods; mIndex++ {
@@ -51,7 +90,7 @@ func RegisterModule(module Module) error {
 			continue
 		}
 		if mSignature.NumIn() != 3 {
-			return createMethodSignatureError(mName)
+			return nil, createMethodSignatureError(mName)
 		}
 		// context.Context
 		in0 := mSignature.In(0)
@@ -62,11 +101,16 @@ func RegisterModule(module Module) error {
 		if in0.Kind() != reflect.Interface || in0 != TypeContext ||
 			in1.Kind() != reflect.Interface || in1 != TypeSocketChannel ||
 			in2.Kind() != reflect.Ptr {
-			return createMethodSignatureError(mName)
+			return nil, createMethodSignatureError(mName)
 		}
-		// outs
-		nOut := mSignature.NumOut()
-		if nOut > 0 {
+		// outs, error can be the last one
+		nOut, outError := mSignature.NumOut(), false
+		if nOut > 0 && mSignature.Out(nOut-1) == TypeError {
+			nOut, outError = nOut-1, true
+		}
+		if nOut > 2 {
+			return nil, createMethodSignatureError(mName)
+		} else if nOut > 0 {
 			// 1st out must be *message.ProtocolMessage or proto.Message if num out equals 0
 			ot := mSignature.Out(0)
 			//
@@ -74,42 +118,56 @@ func RegisterModule(module Module) error {
 				if ot == TypeSmartMessage {
 					mOutType = HandlerOutTypeSmart
 				} else {
-					return createMethodSignatureError(mName)
+					return nil, createMethodSignatureError(mName)
 				}
 			} else {
 				ot1 := mSignature.Out(1)
 				//|| (!ot1.Implements(TypeProtoMessage) && ot1.Kind() != reflect.Slice)
 				if ot.Kind() != reflect.Int {
-					return createMethodSignatureError(mName)
+					return nil, createMethodSignatureError(mName)
 				} else if ot1.Implements(TypeProtoMessage) {
 					mOutType = HandlerOutTypeProtoMessage
-				} else if ot1.Kind() == reflect.Slice {
+				} else if ot1.Kind() == reflect.Slice && ot1.Elem().Kind() == reflect.Uint8 {
 					mOutType = HandlerOutTypeByteSlice
+				} else if ot1.Kind() == reflect.Ptr || ot1.Kind() == reflect.Struct || ot1.Kind() == reflect.Map || ot1.Kind() == reflect.Slice {
+					mOutType = HandlerOutTypeObject
 				} else {
-					return createMethodSignatureError(mName)
+					return nil, createMethodSignatureError(mName)
 				}
 			}
 		}
 		s := handlerMatched[1]
 		if code, err := strconv.Atoi(s); err != nil {
-			return errors.WithMessage(err, fmt.Sprintf("handler name must be match regexp[%s]", handlerRegexp))
+			return nil, errors.WithMessage(err, fmt.Sprintf("handler name must be match regexp[%s]", handlerRegexp))
 		} else {
-			hManager.addHandlerDefinition(&handlerDefinition{
+			var outCodec *message.Codec
+			if oc, ok := outCodecs[code]; ok {
+				outCodec = &oc
+			}
+			hd := &handlerDefinition{
+				module:      module.Name(),
 				messageCode: code,
 				name:        mName,
 				inType:      in2,
 				method:      method,
 				outType:     mOutType,
-			})
+				outError:    outError,
+				outCodec:    outCodec,
+				timeout:     mOpts.timeoutOf(code),
+				dispatch:    mOpts.dispatchKeys[code],
+			}
+			if hd.validator, err = newRequestValidator(in2); err != nil {
+				return nil, errors.WithMessage(err, fmt.Sprintf("handler[%s] request validation", mName))
+			}
+			if mws := mOpts.middlewaresOf(code); len(mws) > 0 {
+				hd.chain = chainMiddleware(hd.invoke, mws)
+			}
+			defs = append(defs, hd)
 		}
 	}
-	//
-	for _, e := range module.Events() {
-		event.Listen(e, module)
-	}
-	return nil
+	return defs, nil
 }
 
 func createMethodSignatureError(mName string) error {
-	return fmt.Errorf("handler signature must be %s(context.Context, Channel, *Any) [ (int, []byte) | proto.Message ]", mName)
+	return fmt.Errorf("handler signature must be %s(context.Context, Channel, *Any) [ (int, []byte) | (int, proto.Message) | (int, *Any) | *message.ProtocolMessage ] [error]", mName)
 }
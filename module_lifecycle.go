@@ -0,0 +1,164 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"time"
+)
+
+// ModuleStopGrace time given to stopping phases, e.g. OnStop of modules, when context of stopping is done or about to,
+// e.g. drain timed out
+const ModuleStopGrace = 10 * time.Second
+
+// ModuleInitializer optional interface of Module, OnInit is called when server is starting, before OnStart.
+// load data here, return error to stop server starting.
+type ModuleInitializer interface {
+	OnInit(ctx context.Context) error
+}
+
+// ModuleStarter optional interface of Module, OnStart is called after OnInit of all modules, before server accepting channels.
+type ModuleStarter interface {
+	OnStart(ctx context.Context) error
+}
+
+// ModuleStopper optional interface of Module, OnStop is called when server shutdown after all task finished.
+// flush state here, server closes listener after OnStop of all modules returned.
+type ModuleStopper interface {
+	OnStop(ctx context.Context) error
+}
+
+// ModuleDependent optional interface of Module, returns names of modules which must be initialized and started before it.
+// modules are stopped in reverse order.
+type ModuleDependent interface {
+	DependsOn() []string
+}
+
+// sortModules order modules by dependencies, modules without dependency keep registration order.
+func sortModules(modules []Module) ([]Module, error) {
+	named := make(map[string]Module, len(modules))
+	for _, m := range modules {
+		named[m.Name()] = m
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(modules))
+	sorted := make([]Module, 0, len(modules))
+	var visit func(m Module, path []string) error
+	visit = func(m Module, path []string) error {
+		switch state[m.Name()] {
+		case visiting:
+			return fmt.Errorf("module dependency cycle: %v", append(path, m.Name()))
+		case visited:
+			return nil
+		}
+		state[m.Name()] = visiting
+		if d, ok := m.(ModuleDependent); ok {
+			for _, dn := range d.DependsOn() {
+				dm, ok := named[dn]
+				if !ok {
+					return fmt.Errorf("module[%s] depends on unregistered module[%s]", m.Name(), dn)
+				}
+				if err := visit(dm, append(path, m.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		state[m.Name()] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+	for _, m := range modules {
+		if err := visit(m, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// checkDependencies returns the error of startModules if module joins modules, e.g. it depends on unregistered module.
+// module of the same name in modules is replaced by it.
+func checkDependencies(module Module, modules []Module) error {
+	joined := make([]Module, 0, len(modules)+1)
+	for _, m := range modules {
+		if m.Name() != module.Name() {
+			joined = append(joined, m)
+		}
+	}
+	_, err := sortModules(append(joined, module))
+	return err
+}
+
+// startModules call OnInit then OnStart of modules in dependency order.
+// modules already started are stopped when any hook failed.
+func startModules(ctx context.Context, modules []Module) ([]Module, error) {
+	sorted, err := sortModules(modules)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range sorted {
+		if mi, ok := m.(ModuleInitializer); ok {
+			ts := time.Now()
+			if err = mi.OnInit(ctx); err != nil {
+				return nil, errors.WithMessage(err, fmt.Sprintf("init module[%s]", m.Name()))
+			}
+			logk.Info("module initialized", zap.String("module", m.Name()), zap.Duration("cost", time.Since(ts)))
+		}
+	}
+	for idx, m := range sorted {
+		if ms, ok := m.(ModuleStarter); ok {
+			if err = ms.OnStart(ctx); err != nil {
+				stopModules(ctx, sorted[:idx])
+				return nil, errors.WithMessage(err, fmt.Sprintf("start module[%s]", m.Name()))
+			}
+			logk.Info("module started", zap.String("module", m.Name()))
+		}
+	}
+	return sorted, nil
+}
+
+// startModule call OnInit then OnStart of a single module, its dependencies must be started already
+func startModule(ctx context.Context, m Module) error {
+	if mi, ok := m.(ModuleInitializer); ok {
+		if err := mi.OnInit(ctx); err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("init module[%s]", m.Name()))
+		}
+	}
+	if ms, ok := m.(ModuleStarter); ok {
+		if err := ms.OnStart(ctx); err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("start module[%s]", m.Name()))
+		}
+	}
+	logk.Info("module started", zap.String("module", m.Name()))
+	return nil
+}
+
+// graceContext ctx if ModuleStopGrace left at least, otherwise a context of ModuleStopGrace keeping values of ctx
+func graceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) >= ModuleStopGrace {
+			return ctx, func() {}
+		}
+	}
+	return context.WithTimeout(context.WithoutCancel(ctx), ModuleStopGrace)
+}
+
+// stopModules call OnStop of sorted modules in reverse order, error of a module does not stop others.
+func stopModules(ctx context.Context, sorted []Module) {
+	for idx := len(sorted) - 1; idx >= 0; idx-- {
+		m := sorted[idx]
+		if ms, ok := m.(ModuleStopper); ok {
+			ts := time.Now()
+			if err := ms.OnStop(ctx); err != nil {
+				logk.Error("stop module error", zap.String("module", m.Name()), zap.Error(err))
+			} else {
+				logk.Info("module stopped", zap.String("module", m.Name()), zap.Duration("cost", time.Since(ts)))
+			}
+		}
+	}
+}
@@ -2,13 +2,17 @@ package smart
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart/message"
 	"github.com/gookit/event"
 	"github.com/stretchr/testify/assert"
 	"regexp"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Req struct {
@@ -27,7 +31,7 @@ func (r *Req) Reset() {
 }
 
 type Res struct {
-	Pong int `json:"pong"`
+	Pong int `json:"pong" msgpack:"pong"`
 }
 
 type TestModule struct {
@@ -74,6 +78,17 @@ func (m *TestModule) StartFightRes1005(ctx context.Context, channel Channel, req
 	logk.Infof("StartFightRes1005 invoked: %s", req)
 }
 
+func (m *TestModule) BuyItem1006(ctx context.Context, channel Channel, req *Req) (int, []byte, error) {
+	if req.Ping < 100 {
+		return 0, nil, NewError(1, "not enough gold")
+	}
+	return 1007, []byte(`{"pong":1007}`), nil
+}
+
+func (m *TestModule) QueryItem1008(ctx context.Context, channel Channel, req *Req) (int, *Res) {
+	return 1009, &Res{Pong: req.Ping}
+}
+
 func TestRegisterModule(t *testing.T) {
 	tm := &TestModule{}
 	err := RegisterModule(tm)
@@ -99,3 +114,251 @@ func TestRegex(t *testing.T) {
 	r1 := regexp.MustCompile("\\D+")
 	t.Logf("%s", r1.ReplaceAllString("Test100113a", ""))
 }
+
+type lifecycleModule struct {
+	TestModule
+	name string
+	deps []string
+	log  *[]string
+}
+
+func (m *lifecycleModule) Name() string {
+	return m.name
+}
+
+func (m *lifecycleModule) DependsOn() []string {
+	return m.deps
+}
+
+func (m *lifecycleModule) OnInit(ctx context.Context) error {
+	*m.log = append(*m.log, "init:"+m.name)
+	return nil
+}
+
+func (m *lifecycleModule) OnStart(ctx context.Context) error {
+	*m.log = append(*m.log, "start:"+m.name)
+	return nil
+}
+
+func (m *lifecycleModule) OnStop(ctx context.Context) error {
+	*m.log = append(*m.log, "stop:"+m.name)
+	return nil
+}
+
+func TestModuleLifecycle(t *testing.T) {
+	var log []string
+	guild := &lifecycleModule{name: "guild", deps: []string{"player", "mail"}, log: &log}
+	player := &lifecycleModule{name: "player", log: &log}
+	mail := &lifecycleModule{name: "mail", deps: []string{"player"}, log: &log}
+	sorted, err := startModules(context.Background(), []Module{guild, player, mail})
+	assert.Nil(t, err)
+	stopModules(context.Background(), sorted)
+	assert.Equal(t, []string{
+		"init:player", "init:mail", "init:guild",
+		"start:player", "start:mail", "start:guild",
+		"stop:guild", "stop:mail", "stop:player",
+	}, log)
+	// cycle
+	player.deps = []string{"guild"}
+	_, err = sortModules([]Module{guild, player, mail})
+	assert.NotNil(t, err)
+	// unregistered dependency
+	_, err = sortModules([]Module{mail})
+	assert.NotNil(t, err)
+}
+
+// hookModule touches router in its hooks
+type hookModule struct {
+	lifecycleModule
+	onStart, onStop func(ctx context.Context) error
+}
+
+func (m *hookModule) OnStart(ctx context.Context) error {
+	_ = m.lifecycleModule.OnStart(ctx)
+	if m.onStart == nil {
+		return nil
+	}
+	return m.onStart(ctx)
+}
+
+func (m *hookModule) OnStop(ctx context.Context) error {
+	_ = m.lifecycleModule.OnStop(ctx)
+	if m.onStop == nil {
+		return nil
+	}
+	return m.onStop(ctx)
+}
+
+func TestModuleHooksTouchRouter(t *testing.T) {
+	var log []string
+	r := NewRouter().(*handlerManager)
+	plugin := &lifecycleModule{name: "plugin", log: &log}
+	host := &hookModule{
+		lifecycleModule: lifecycleModule{name: "host", log: &log},
+		onStart:         func(ctx context.Context) error { return r.RegisterModule(plugin) },
+		onStop:          func(ctx context.Context) error { return r.UnregisterModule(ctx, "plugin") },
+	}
+	assert.Nil(t, r.RegisterModule(host))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(t, r.start(context.Background()))
+		_, m := r.routes().module("plugin")
+		assert.Equal(t, plugin, m)
+		r.stop(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("hooks of module deadlocked router")
+	}
+	assert.Equal(t, []string{"init:host", "start:host", "init:plugin", "start:plugin", "stop:plugin", "stop:host"}, log)
+	_, m := r.routes().module("plugin")
+	assert.Nil(t, m)
+}
+
+type swapModule struct {
+	version int
+	block   chan struct{}
+}
+
+func (m *swapModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *swapModule) Name() string {
+	return "swapModule"
+}
+
+func (m *swapModule) Events() []string {
+	return nil
+}
+
+func (m *swapModule) Version3001(ctx context.Context, channel Channel, req *Req) (int, *Res) {
+	if m.block != nil {
+		<-m.block
+	}
+	return 3001, &Res{Pong: m.version}
+}
+
+func TestReplaceModule(t *testing.T) {
+	c := &mockChannel{ctx: context.Background()}
+	req := func() *message.ProtocolMessage {
+		return &message.ProtocolMessage{Route: 3001, Codec: message.Codec_JSON, Payload: []byte(`{}`)}
+	}
+	v1 := &swapModule{version: 1, block: make(chan struct{})}
+	assert.Nil(t, RegisterModule(v1))
+	// in-flight invocation of v1
+	done := make(chan struct{})
+	go func() {
+		hManager.invokeHandler(c.ctx, &mockChannel{ctx: c.ctx}, req())
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// replace must wait for v1 finished
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, ReplaceModule(ctx, &swapModule{version: 2}))
+	hManager.invokeHandler(c.ctx, c, req())
+	assert.JSONEq(t, `{"pong":2}`, string(c.sent[0].Payload))
+	close(v1.block)
+	<-done
+	// unregister
+	assert.Nil(t, UnregisterModule(context.Background(), "swapModule"))
+	hManager.invokeHandler(c.ctx, c, req())
+	assert.Equal(t, RouteError, c.sent[1].Route)
+	assert.Equal(t, strconv.Itoa(int(ErrCodeRouteNotFound)), c.sent[1].Header[HeaderErrorCode])
+	assert.NotNil(t, UnregisterModule(context.Background(), "swapModule"))
+}
+
+// startedSwapModule swapModule with lifecycle
+type startedSwapModule struct {
+	swapModule
+	onStart func(ctx context.Context) error
+	stopped int32
+	stopErr error // error of ctx of OnStop
+}
+
+func (m *startedSwapModule) OnStart(ctx context.Context) error {
+	if m.onStart != nil {
+		return m.onStart(ctx)
+	}
+	return nil
+}
+
+func (m *startedSwapModule) OnStop(ctx context.Context) error {
+	m.stopErr = ctx.Err()
+	atomic.AddInt32(&m.stopped, 1)
+	return nil
+}
+
+func TestReplaceRunningModule(t *testing.T) {
+	r := NewRouter().(*handlerManager)
+	assert.Nil(t, r.start(context.Background()))
+	defer r.stop(context.Background())
+	v1 := &startedSwapModule{swapModule: swapModule{version: 1, block: make(chan struct{})}}
+	assert.Nil(t, r.RegisterModule(v1))
+	done := make(chan struct{})
+	go func() {
+		r.invokeHandler(context.Background(), &mockChannel{ctx: context.Background()}, &message.ProtocolMessage{Route: 3001, Codec: message.Codec_JSON, Payload: []byte(`{}`)})
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// OnStart of new module touches router
+	var log []string
+	v2 := &startedSwapModule{swapModule: swapModule{version: 2}}
+	v2.onStart = func(ctx context.Context) error { return r.RegisterModule(&lifecycleModule{name: "extra", log: &log}) }
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := r.ReplaceModule(ctx, v2)
+	// replaced even drain of v1 timed out, v1 stopped with time of grace
+	assert.ErrorContains(t, err, "module [swapModule] replaced")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&v1.stopped))
+	assert.Nil(t, v1.stopErr)
+	assert.Equal(t, []string{"init:extra", "start:extra"}, log)
+	c := &mockChannel{ctx: context.Background()}
+	r.invokeHandler(c.ctx, c, &message.ProtocolMessage{Route: 3001, Codec: message.Codec_JSON, Payload: []byte(`{}`)})
+	assert.JSONEq(t, `{"pong":2}`, string(c.sent[0].Payload))
+	close(v1.block)
+	<-done
+	// module failed to start is not registered
+	assert.NotNil(t, r.ReplaceModule(context.Background(), &startedSwapModule{onStart: func(ctx context.Context) error { return errors.New("boom") }}))
+	assert.Zero(t, atomic.LoadInt32(&v2.stopped))
+	// module of duplicated name is ignored before started
+	dup := &startedSwapModule{onStart: func(ctx context.Context) error {
+		t.Error("duplicated module started")
+		return nil
+	}}
+	assert.Nil(t, r.RegisterModule(dup))
+	assert.Zero(t, atomic.LoadInt32(&dup.stopped))
+	// module started at runtime gets bus of router and its dependencies are checked, as modules started with router
+	var bus *EventBus
+	assert.Nil(t, r.RegisterModule(&hookModule{
+		lifecycleModule: lifecycleModule{name: "bus", log: &log},
+		onStart: func(ctx context.Context) error {
+			bus = EventBusOf(ctx)
+			return nil
+		},
+	}))
+	assert.Equal(t, r.bus, bus)
+	assert.ErrorContains(t, r.RegisterModule(&lifecycleModule{name: "orphan", deps: []string{"missing"}, log: &log}), "depends on unregistered module[missing]")
+	assert.Equal(t, []string{"init:extra", "start:extra", "init:bus", "start:bus"}, log)
+}
+
+func TestRouterIsolation(t *testing.T) {
+	r1, r2 := NewRouter(), NewRouter()
+	assert.Nil(t, r1.RegisterModule(&swapModule{version: 1}))
+	assert.Nil(t, r2.RegisterModule(&swapModule{version: 2}))
+	ch := &defaultChannel{}
+	WithRouter(r2)(ch)
+	assert.Equal(t, r2, Router(routerOf(ch)))
+	assert.Equal(t, DefaultRouter(), Router(routerOf(&mockChannel{})))
+	c := &mockChannel{ctx: context.Background()}
+	for _, r := range []Router{r1, r2} {
+		r.(*handlerManager).invokeHandler(c.ctx, c, &message.ProtocolMessage{Route: 3001, Codec: message.Codec_JSON, Payload: []byte(`{}`)})
+	}
+	assert.JSONEq(t, `{"pong":1}`, string(c.sent[0].Payload))
+	assert.JSONEq(t, `{"pong":2}`, string(c.sent[1].Payload))
+	assert.Len(t, r1.Metrics(), 1)
+}
@@ -0,0 +1,57 @@
+package smart
+
+import (
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/message"
+	"go.uber.org/zap"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// HandlerPanic context of a handler panicked
+type HandlerPanic struct {
+	Value   interface{} // recovered value
+	Stack   []byte
+	Route   int32
+	Seq     int32
+	Channel int         // fd of channel
+	Request interface{} // decoded request
+	Count   int         // panics caused by the channel so far
+}
+
+// PanicPolicy handles panics of handlers, the client always receives a generic internal error
+type PanicPolicy struct {
+	// CloseAfter close channel once it caused CloseAfter panics, <= 0 never closes
+	CloseAfter int
+	// OnPanic called with context of every panic, e.g. alerting
+	OnPanic func(p *HandlerPanic)
+}
+
+// panicError error responded for a panic, close channel after response sent if closeChannel
+type panicError struct {
+	value        interface{}
+	closeChannel bool
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.value)
+}
+
+// onPanic record panic of handler and apply policy of router
+func (hm *handlerManager) onPanic(v interface{}, hd *handlerDefinition, c Channel, req *message.ProtocolMessage, in interface{}) error {
+	hp := &HandlerPanic{Value: v, Stack: debug.Stack(), Route: req.GetRoute(), Seq: req.GetSeq(), Channel: c.GetFd(), Request: in}
+	if dc, ok := c.(*defaultChannel); ok {
+		hp.Count = int(atomic.AddInt32(&dc.panics, 1))
+	}
+	logk.Error("handler panic", zap.String("handler", hd.name), zap.Int32("route", hp.Route), zap.Int32("seq", hp.Seq),
+		zap.Int("channel", hp.Channel), zap.Any("request", in), zap.Any("recover", v), zap.ByteString("stack", hp.Stack))
+	pe := &panicError{value: v}
+	if policy := hm.panicPolicy.Load(); policy != nil {
+		if policy.OnPanic != nil {
+			policy.OnPanic(hp)
+		}
+		pe.closeChannel = policy.CloseAfter > 0 && hp.Count >= policy.CloseAfter
+	}
+	return pe
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"syscall"
+)
+
+// NetTLSConn conn over tls. tls is not event driven, call Fill on a goroutine of the conn to read data for Reader.
+func NetTLSConn(conn *tls.Conn) *TLSConn {
+	return &TLSConn{conn: conn, fd: fdOf(conn), r: &bufReader{}, w: &tlsWriter{conn: conn}}
+}
+
+type TLSConn struct {
+	conn *tls.Conn
+	fd   int
+	r    *bufReader
+	w    *tlsWriter
+}
+
+// Fill read data decrypted from conn into Reader, blocks until data arrived
+func (c *TLSConn) Fill() error {
+	return c.r.fill(c.conn)
+}
+
+// ConnectionState state of tls, e.g. certificates of peer
+func (c *TLSConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState()
+}
+
+func (c *TLSConn) Fd() int {
+	return c.fd
+}
+
+func (c *TLSConn) Reader() Reader {
+	return c.r
+}
+
+func (c *TLSConn) Writer() Writer {
+	return c.w
+}
+
+func (c *TLSConn) Close() error {
+	return c.conn.Close()
+}
+
+// seqTLSConn ids of conns without fd, negative so they never clash with fd
+var seqTLSConn int64
+
+// fdOf fd of socket under tls, a unique negative id if unknown, e.g. conn over pipe
+func fdOf(conn *tls.Conn) int {
+	fd := -1
+	if sc, ok := conn.NetConn().(syscall.Conn); ok {
+		if raw, err := sc.SyscallConn(); err == nil {
+			_ = raw.Control(func(f uintptr) {
+				fd = int(f)
+			})
+		}
+	}
+	if fd < 0 {
+		fd = int(-atomic.AddInt64(&seqTLSConn, 1))
+	}
+	return fd
+}
+
+// bufReader Reader over data filled, used by the goroutine filling it only
+type bufReader struct {
+	buf []byte
+	off int
+}
+
+func (r *bufReader) fill(src io.Reader) error {
+	if len(r.buf) == cap(r.buf) {
+		buf := make([]byte, len(r.buf), max(2*cap(r.buf), 4096))
+		copy(buf, r.buf)
+		r.buf = buf
+	}
+	n, err := src.Read(r.buf[len(r.buf):cap(r.buf)])
+	r.buf = r.buf[:len(r.buf)+n]
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+func (r *bufReader) Peek(n int) ([]byte, error) {
+	if r.Len() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r.buf[r.off : r.off+n], nil
+}
+
+func (r *bufReader) Skip(n int) error {
+	if r.Len() < n {
+		return io.ErrUnexpectedEOF
+	}
+	r.off += n
+	return nil
+}
+
+func (r *bufReader) ReadBinary(n int) ([]byte, error) {
+	if r.Len() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p := make([]byte, n)
+	copy(p, r.buf[r.off:])
+	r.off += n
+	return p, nil
+}
+
+// Release drop data read, slices returned by Peek become invalid
+func (r *bufReader) Release() error {
+	if r.off > 0 {
+		r.buf = r.buf[:copy(r.buf, r.buf[r.off:])]
+		r.off = 0
+	}
+	return nil
+}
+
+func (r *bufReader) Len() int {
+	return len(r.buf) - r.off
+}
+
+// tlsWriter buffer data until Flush, callers serialize writes, e.g. lock of channel
+type tlsWriter struct {
+	conn *tls.Conn
+	buf  []byte
+}
+
+func (w *tlsWriter) WriteBinary(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
+
+func (w *tlsWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.conn.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
@@ -0,0 +1,193 @@
+package smart
+
+import (
+	"context"
+	stderrors "errors"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionDirectory records which gate users are connected to.
+// gates bind users logged in on them, backends look up gates of users to push messages.
+// share it between gates and backends, e.g. implement it with redis.
+type SessionDirectory interface {
+	// Bind user to gate
+	Bind(ctx context.Context, userId, gateId string) error
+	// Unbind user from gate, ignored if user already bound to other gate
+	Unbind(ctx context.Context, userId, gateId string) error
+	// Lookup gates of users, key is user id, value is gate id. users not connected are absent
+	Lookup(ctx context.Context, userIds ...string) (map[string]string, error)
+}
+
+// NewMemorySessionDirectory session directory in memory, for gates and backends in the same process
+func NewMemorySessionDirectory() SessionDirectory {
+	return &memorySessionDirectory{users: map[string]string{}}
+}
+
+type memorySessionDirectory struct {
+	lock  sync.RWMutex
+	users map[string]string
+}
+
+func (d *memorySessionDirectory) Bind(ctx context.Context, userId, gateId string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.users[userId] = gateId
+	return nil
+}
+
+func (d *memorySessionDirectory) Unbind(ctx context.Context, userId, gateId string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.users[userId] == gateId {
+		delete(d.users, userId)
+	}
+	return nil
+}
+
+func (d *memorySessionDirectory) Lookup(ctx context.Context, userIds ...string) (map[string]string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	gates := make(map[string]string, len(userIds))
+	for _, uid := range userIds {
+		if gateId, ok := d.users[uid]; ok {
+			gates[uid] = gateId
+		}
+	}
+	return gates, nil
+}
+
+// Pusher push messages from backend to users through gates holding them.
+// messages are sent over links established by gates, attach pusher to backend server by Pusher.Initializer.
+// only trusted links are accepted: channels of Pusher.TrustedInitializer, e.g. listener on internal network,
+// and peers verified by mutual tls.
+// messages pushed to a user are delivered in order.
+type Pusher struct {
+	directory SessionDirectory
+	links     sync.Map // key=gate id, value=Channel
+}
+
+// gateLinks channels trusted to link gates, see Pusher.TrustedInitializer
+var gateLinks sync.Map // key=Channel
+
+// trustedLink returns true if channel is trusted to link gates: channels of Pusher.TrustedInitializer and peers verified by mutual tls.
+// headers stamped by gate, e.g. HeaderUserId, are trusted only on them.
+func trustedLink(channel Channel) bool {
+	_, ok := gateLinks.Load(channel)
+	return ok || verifiedPeer(channel)
+}
+
+// NewPusher create pusher look up gates of users in directory
+func NewPusher(dir SessionDirectory) *Pusher {
+	return &Pusher{directory: dir}
+}
+
+var defaultPusher atomic.Pointer[Pusher]
+
+// SetPusher set pusher used by PushToUser and PushToUsers
+func SetPusher(p *Pusher) {
+	defaultPusher.Store(p)
+}
+
+// PushToUser push msg to user by pusher set by SetPusher
+func PushToUser(ctx context.Context, userId string, msg *message.ProtocolMessage) error {
+	return PushToUsers(ctx, []string{userId}, msg)
+}
+
+// PushToUsers push msg to users by pusher set by SetPusher
+func PushToUsers(ctx context.Context, userIds []string, msg *message.ProtocolMessage) error {
+	p := defaultPusher.Load()
+	if p == nil {
+		return errors.New("pusher not set, see SetPusher")
+	}
+	return p.PushToUsers(ctx, userIds, msg)
+}
+
+// Initializer attach pusher to channels of backend server to learn links of gates
+func (p *Pusher) Initializer() ChannelInitializer {
+	return func(channel Channel) {
+		AppendHandler(func() ChannelHandler { return p })(channel)
+		AppendMessageInterceptor(func() MessageInterceptor { return p })(channel)
+	}
+}
+
+// TrustedInitializer attach pusher to channels of listener trusted to link gates, e.g. Server.Listen on internal network
+func (p *Pusher) TrustedInitializer() ChannelInitializer {
+	return func(channel Channel) {
+		gateLinks.Store(channel, struct{}{})
+		p.Initializer()(channel)
+	}
+}
+
+// PushToUser push msg to user, ignored if user not connected
+func (p *Pusher) PushToUser(ctx context.Context, userId string, msg *message.ProtocolMessage) error {
+	return p.PushToUsers(ctx, []string{userId}, msg)
+}
+
+// PushToUsers push msg to users, users on the same gate share one message. users not connected are ignored
+func (p *Pusher) PushToUsers(ctx context.Context, userIds []string, msg *message.ProtocolMessage) error {
+	gates, err := p.directory.Lookup(ctx, userIds...)
+	if err != nil {
+		return errors.WithMessage(err, "lookup gates of users")
+	}
+	users := map[string][]string{} // key=gate id
+	for uid, gateId := range gates {
+		users[gateId] = append(users[gateId], uid)
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.WithMessage(err, "encode pushed message")
+	}
+	var errs []error
+	for gateId, uids := range users {
+		link, ok := p.links.Load(gateId)
+		if !ok {
+			errs = append(errs, errors.Errorf("no link to gate [%s]", gateId))
+			continue
+		}
+		push := &message.ProtocolMessage{Route: RoutePush, Header: map[string]string{HeaderToUsers: strings.Join(uids, ",")}, Payload: payload}
+		if err = link.(Channel).Send(push); err != nil {
+			errs = append(errs, errors.WithMessage(err, "push to gate: "+gateId))
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+// BeforeInvoke record link of gate by RouteGateHello, the hello is not passed to handlers
+func (p *Pusher) BeforeInvoke(ctx context.Context, channel Channel, msg *message.ProtocolMessage) error {
+	if msg.GetRoute() != RouteGateHello {
+		return nil
+	}
+	gateId := msg.GetHeader()[HeaderGateId]
+	if !trustedLink(channel) {
+		logk.Warn("gate hello from untrusted channel", zap.String("gate", gateId), zap.Int("channel", channel.GetFd()))
+		return errors.New("gate hello from untrusted channel")
+	}
+	p.links.Store(gateId, channel)
+	logk.Info("gate linked", zap.String("gate", gateId), zap.Int("channel", channel.GetFd()))
+	return errors.New("gate hello handled")
+}
+
+func (p *Pusher) AfterInvoke(ctx context.Context, channel Channel, msg *message.ProtocolMessage) error {
+	return nil
+}
+
+func (p *Pusher) OnOpen(channel Channel) {
+}
+
+// OnClose forget link of gate
+func (p *Pusher) OnClose(channel Channel) {
+	gateLinks.Delete(channel)
+	p.links.Range(func(key, value interface{}) bool {
+		if value == channel {
+			p.links.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
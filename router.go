@@ -0,0 +1,89 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Router registry of modules and their routes. attach it to a server by Server.SetRouter,
+// or to channels by ChannelInitializer WithRouter along with Server.UseRouter. package level RegisterModule uses DefaultRouter.
+type Router interface {
+	// RegisterModule register handlers and event listener of module, opts declare middlewares of module or routes.
+	// module registered when router is running will be initialized and started immediately.
+	RegisterModule(module Module, opts ...ModuleOption) error
+	// UnregisterModule remove routes and event listener of module while server is running,
+	// returns after in-flight invocations of its handlers finished(or ctx done) and OnStop called.
+	UnregisterModule(ctx context.Context, name string) error
+	// ReplaceModule atomically swap routes of module registered with the same name to the new one,
+	// in-flight invocations of old handlers are drained before old module OnStop called.
+	ReplaceModule(ctx context.Context, module Module, opts ...ModuleOption) error
+	// Metrics returns metrics of all registered routes, ordered by route
+	Metrics() []RouteMetrics
+	// EventBus typed event bus of modules in router
+	EventBus() *EventBus
+	// SetSlowHandlerThreshold invocation exceeds threshold is logged with its stack, <= 0 disables watchdog.
+	// default is DefaultSlowHandlerThreshold
+	SetSlowHandlerThreshold(threshold time.Duration)
+	// SetPanicPolicy set policy for panics of handlers, panics are logged with their context anyway
+	SetPanicPolicy(policy PanicPolicy)
+}
+
+// NewRouter create an empty router
+func NewRouter() Router {
+	return newHandlerManager(fmt.Sprintf("router-%d", atomic.AddInt32(&routerSeq, 1)))
+}
+
+// DefaultRouter router used by package level functions and servers without SetRouter
+func DefaultRouter() Router {
+	return hManager
+}
+
+// WithRouter handle messages of channel with router r instead of the router of server,
+// r must be used by server as well, see Server.UseRouter, otherwise modules of it are never started and channel is refused.
+func WithRouter(r Router) ChannelInitializer {
+	return func(channel Channel) {
+		channel.(*defaultChannel).router = r.(*handlerManager)
+	}
+}
+
+// routerOf returns router of channel, DefaultRouter if not set
+func routerOf(c Channel) *handlerManager {
+	if dc, ok := c.(*defaultChannel); ok && dc.router != nil {
+		return dc.router
+	}
+	return hManager
+}
+
+func (hm *handlerManager) RegisterModule(module Module, opts ...ModuleOption) error {
+	defs, err := newModuleHandlers(module, opts)
+	if err != nil {
+		return err
+	}
+	return hm.registerModule(module, defs)
+}
+
+func (hm *handlerManager) UnregisterModule(ctx context.Context, name string) error {
+	return hm.unregisterModule(ctx, name)
+}
+
+func (hm *handlerManager) ReplaceModule(ctx context.Context, module Module, opts ...ModuleOption) error {
+	defs, err := newModuleHandlers(module, opts)
+	if err != nil {
+		return err
+	}
+	return hm.replaceModule(ctx, module, defs)
+}
+
+func (hm *handlerManager) EventBus() *EventBus {
+	return hm.bus
+}
+
+func (hm *handlerManager) SetPanicPolicy(policy PanicPolicy) {
+	hm.panicPolicy.Store(&policy)
+}
+
+func (hm *handlerManager) SetSlowHandlerThreshold(threshold time.Duration) {
+	hm.dog.setThreshold(threshold)
+}
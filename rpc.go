@@ -0,0 +1,450 @@
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart-kit/pkg/utilk"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRpcConnClosed connection closed before response received, call of idempotent route is retried
+var ErrRpcConnClosed = errors.New("rpc connection closed")
+
+// RpcOption option of NewRpcClient
+type RpcOption func(c *RpcClient)
+
+// WithRpcInitializers initializers of rpc connections, e.g. codec and byte order. default is smart codec with LittleEndian
+func WithRpcInitializers(initializers ...ChannelInitializer) RpcOption {
+	return func(c *RpcClient) {
+		c.initializers = initializers
+	}
+}
+
+// WithRpcTLS connections to instances over tls, e.g. mutual tls across data centers. see TLSConfig.ClientConfig
+func WithRpcTLS(conf *tls.Config) RpcOption {
+	return func(c *RpcClient) {
+		c.tls = conf
+	}
+}
+
+// WithRpcPoolSize connections to each instance, calls are multiplexed on them. default is 2
+func WithRpcPoolSize(n int) RpcOption {
+	return func(c *RpcClient) {
+		c.poolSize = max(n, 1)
+	}
+}
+
+// WithRpcTimeout deadline of call whose context has no deadline. default is 5s
+func WithRpcTimeout(d time.Duration) RpcOption {
+	return func(c *RpcClient) {
+		c.timeout = d
+	}
+}
+
+// WithIdempotentRoutes calls of routes are retried on other instances at most retries times
+// when connection failed or closed before response received
+func WithIdempotentRoutes(retries int, routes ...int32) RpcOption {
+	return func(c *RpcClient) {
+		c.retries = retries
+		for _, route := range routes {
+			c.idempotent[route] = true
+		}
+	}
+}
+
+// WithPropagateHeaders headers of the request being handled are propagated to calls made in its handler.
+// default are HeaderTraceId and HeaderUserId
+func WithPropagateHeaders(keys ...string) RpcOption {
+	return func(c *RpcClient) {
+		c.propagate = keys
+	}
+}
+
+// RpcClient call routes of other smart services. instance of service is found by discovery,
+// calls are multiplexed on pooled connections and correlated with responses by seq.
+type RpcClient struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	discovery    Discovery
+	initializers []ChannelInitializer
+	tls          *tls.Config
+	poolSize     int
+	timeout      time.Duration
+	retries      int
+	idempotent   map[int32]bool
+	propagate    []string
+	lock         sync.Mutex
+	services     map[string]*rpcService
+}
+
+// NewRpcClient create rpc client find instances of services by discovery
+func NewRpcClient(d Discovery, opts ...RpcOption) *RpcClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &RpcClient{
+		ctx:          ctx,
+		cancel:       cancel,
+		discovery:    d,
+		initializers: defaultLinkInitializers(),
+		poolSize:     2,
+		timeout:      5 * time.Second,
+		idempotent:   map[int32]bool{},
+		propagate:    []string{HeaderTraceId, HeaderUserId},
+		services:     map[string]*rpcService{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var defaultRpcClient atomic.Pointer[RpcClient]
+
+// SetRpcClient set client used by Invoke
+func SetRpcClient(c *RpcClient) {
+	defaultRpcClient.Store(c)
+}
+
+// Invoke call route of service by client set by SetRpcClient, response payload is decoded to T.
+// req of proto.Message is encoded with protobuf, others with json.
+// error response of service is returned as *Error
+func Invoke[T any](ctx context.Context, service string, route int32, req interface{}) (*T, error) {
+	c := defaultRpcClient.Load()
+	if c == nil {
+		return nil, errors.New("rpc client not set, see SetRpcClient")
+	}
+	return InvokeWith[T](ctx, c, service, route, req)
+}
+
+// InvokeWith call route of service by client c, see Invoke
+func InvokeWith[T any](ctx context.Context, c *RpcClient, service string, route int32, req interface{}) (*T, error) {
+	res, err := c.Call(ctx, service, route, req)
+	if err != nil {
+		return nil, err
+	}
+	out := new(T)
+	_codec := findMessageCodec(nil, res.GetCodec())
+	if _codec == nil {
+		return nil, errors.Errorf("codec %s of response not supported", res.GetCodec().String())
+	}
+	buf := utilk.NewLinkBuffer(res.GetPayload())
+	defer buf.Release()
+	if err = _codec.Decode(buf, out); err != nil {
+		return nil, errors.WithMessage(err, "decode response")
+	}
+	return out, nil
+}
+
+// Call route of service, returns response message
+func (c *RpcClient) Call(ctx context.Context, service string, route int32, req interface{}) (*message.ProtocolMessage, error) {
+	msg, err := c.newRequest(ctx, route, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	msg.Header[HeaderDeadline] = strconv.FormatInt(deadline.UnixMilli(), 10)
+	//
+	s, err := c.service(service)
+	if err != nil {
+		return nil, err
+	}
+	tried := map[string]bool{}
+	for attempt := 0; ; attempt++ {
+		pool := s.pick(tried)
+		if pool == nil {
+			return nil, NewErrorf(ErrCodeServiceUnavailable, "service [%s] unavailable", service)
+		}
+		tried[pool.ins.Address] = true
+		res, err := pool.call(ctx, msg)
+		if err == nil {
+			if res.GetRoute() == RouteError {
+				return nil, decodeErrorResponse(res)
+			}
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !c.idempotent[route] || attempt >= c.retries {
+			return nil, err
+		}
+		logk.Warn("rpc call failed, retry", zap.String("service", service), zap.String("instance", pool.ins.Address),
+			zap.Int32("route", route), zap.Error(err))
+	}
+}
+
+// Close close all connections
+func (c *RpcClient) Close() {
+	c.cancel()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.services {
+		s.update(nil)
+	}
+}
+
+func (c *RpcClient) newRequest(ctx context.Context, route int32, req interface{}) (*message.ProtocolMessage, error) {
+	msg := &message.ProtocolMessage{Route: route, Codec: message.Codec_JSON, Header: map[string]string{}}
+	if _, ok := req.(proto.Message); ok {
+		msg.Codec = message.Codec_PROTO
+	}
+	payload, err := findMessageCodec(nil, msg.Codec).Encode(req)
+	if err != nil {
+		return nil, errors.WithMessage(err, "encode request")
+	}
+	msg.Payload = payload
+	if header, ok := ctx.Value(CtxKeyHeader).(map[string]string); ok {
+		for _, key := range c.propagate {
+			if v, ok := header[key]; ok {
+				msg.Header[key] = v
+			}
+		}
+	}
+	if from, ok := ctx.Value(CtxKeyService).(string); ok {
+		msg.Header[HeaderFromService] = from
+	}
+	return msg, nil
+}
+
+// service returns instances of service, watch them by discovery when first called
+func (c *RpcClient) service(name string) (*rpcService, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, ok := c.services[name]; ok {
+		return s, nil
+	}
+	s := &rpcService{client: c, name: name, pools: map[string]*rpcPool{}}
+	if err := c.discovery.Watch(c.ctx, name, func(instances []Instance) {
+		s.update(healthyInstances(instances))
+	}); err != nil {
+		return nil, errors.WithMessage(err, "discover service: "+name)
+	}
+	c.services[name] = s
+	return s, nil
+}
+
+func decodeErrorResponse(res *message.ProtocolMessage) error {
+	e := &Error{}
+	buf := utilk.NewLinkBuffer(res.GetPayload())
+	defer buf.Release()
+	if err := findMessageCodec(nil, message.Codec_JSON).Decode(buf, e); err != nil {
+		return errors.WithMessage(err, "decode error response")
+	}
+	return e
+}
+
+// rpcService connection pools of instances of service
+type rpcService struct {
+	client *RpcClient
+	name   string
+	lock   sync.RWMutex
+	pools  map[string]*rpcPool // key=address
+}
+
+func (s *rpcService) update(instances []Instance) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	desired := make(map[string]Instance, len(instances))
+	for _, ins := range instances {
+		desired[ins.Address] = ins
+	}
+	for addr, pool := range s.pools {
+		if ins, ok := desired[addr]; !ok {
+			delete(s.pools, addr)
+			pool.close()
+		} else {
+			pool.weight = ins.Weight
+		}
+	}
+	for addr, ins := range desired {
+		if _, ok := s.pools[addr]; !ok {
+			s.pools[addr] = &rpcPool{client: s.client, ins: ins, weight: ins.Weight, dialed: make(chan struct{})}
+		}
+	}
+}
+
+// pick instance not tried, instance with higher weight is preferred
+func (s *rpcService) pick(tried map[string]bool) *rpcPool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	instances := make([]Instance, 0, len(s.pools))
+	for addr, pool := range s.pools {
+		if !tried[addr] {
+			instances = append(instances, Instance{Address: addr, Weight: pool.weight})
+		}
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	return s.pools[shuffleByWeight(instances)[0].Address]
+}
+
+// rpcPool connections to an instance
+type rpcPool struct {
+	client  *RpcClient
+	ins     Instance
+	weight  int // guarded by lock of rpcService
+	lock    sync.Mutex
+	conns   []*rpcConn
+	next    uint32
+	closed  bool
+	dialing int           // connections being dialed without lock
+	dialed  chan struct{} // closed when a dial finished
+}
+
+func (p *rpcPool) call(ctx context.Context, msg *message.ProtocolMessage) (*message.ProtocolMessage, error) {
+	conn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.call(ctx, msg)
+}
+
+// get connection round-robin, dial new one until pool is full.
+// dial runs without lock, so a slow instance never blocks callers having connections.
+func (p *rpcPool) get(ctx context.Context) (*rpcConn, error) {
+	p.lock.Lock()
+	for len(p.conns)+p.dialing >= p.client.poolSize {
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrRpcConnClosed
+		}
+		if len(p.conns) > 0 {
+			defer p.lock.Unlock()
+			return p.pick(), nil
+		}
+		// all connections are being dialed, wait for one of them
+		dialed := p.dialed
+		p.lock.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.lock.Lock()
+	}
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrRpcConnClosed
+	}
+	p.dialing++
+	p.lock.Unlock()
+	//
+	conn := &rpcConn{pool: p}
+	initializers := append(append([]ChannelInitializer{}, p.client.initializers...),
+		AppendHandler(func() ChannelHandler { return conn }),
+		AppendMessageHandler(func() MessageHandler { return conn }),
+	)
+	channel, err := dialLink(p.client.ctx, p.ins.network(), p.ins.Address, p.client.tls, initializers)
+	//
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err == nil {
+		conn.channel = channel
+		if p.closed {
+			_ = channel.Close()
+			return nil, ErrRpcConnClosed
+		}
+		p.conns = append(p.conns, conn)
+		return conn, nil
+	}
+	if len(p.conns) == 0 {
+		return nil, errors.WithMessage(err, "connect to "+p.ins.Address)
+	}
+	logk.Warn("connect to rpc instance failed, use existing connections", zap.String("instance", p.ins.Address), zap.Error(err))
+	return p.pick(), nil
+}
+
+// pick connection round-robin, must hold lock and have connections
+func (p *rpcPool) pick() *rpcConn {
+	p.next++
+	return p.conns[p.next%uint32(len(p.conns))]
+}
+
+func (p *rpcPool) remove(conn *rpcConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *rpcPool) close() {
+	p.lock.Lock()
+	conns := p.conns
+	p.conns, p.closed = nil, true
+	p.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.channel.Close()
+	}
+}
+
+// rpcConn connection multiplexed by calls, response is correlated with call by seq
+type rpcConn struct {
+	pool    *rpcPool
+	channel Channel
+	seq     int32
+	pending sync.Map // key=seq, value=chan *message.ProtocolMessage
+}
+
+func (rc *rpcConn) call(ctx context.Context, msg *message.ProtocolMessage) (*message.ProtocolMessage, error) {
+	req := proto.Clone(msg).(*message.ProtocolMessage)
+	req.Seq = atomic.AddInt32(&rc.seq, 1)
+	done := make(chan *message.ProtocolMessage, 1)
+	rc.pending.Store(req.Seq, done)
+	defer rc.pending.Delete(req.Seq)
+	if err := rc.channel.Send(req); err != nil {
+		return nil, errors.WithMessage(ErrRpcConnClosed, err.Error())
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res, ok := <-done:
+		if !ok {
+			return nil, ErrRpcConnClosed
+		}
+		return res, nil
+	}
+}
+
+func (rc *rpcConn) OnOpen(channel Channel) {
+}
+
+// OnClose fail pending calls
+func (rc *rpcConn) OnClose(channel Channel) {
+	rc.pool.remove(rc)
+	rc.pending.Range(func(key, value interface{}) bool {
+		if _, ok := rc.pending.LoadAndDelete(key); ok {
+			close(value.(chan *message.ProtocolMessage))
+		}
+		return true
+	})
+}
+
+// OnMessage response of call, message is recycled after returned so it is cloned
+func (rc *rpcConn) OnMessage(ctx context.Context, channel Channel, msg *message.ProtocolMessage) error {
+	if done, ok := rc.pending.LoadAndDelete(msg.GetSeq()); ok {
+		done.(chan *message.ProtocolMessage) <- proto.Clone(msg).(*message.ProtocolMessage)
+	} else {
+		logk.Debug("response of rpc call is late or unknown", zap.String("instance", rc.pool.ins.Address), zap.Int32("seq", msg.GetSeq()))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/gookit/event"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+type rpcModule struct {
+	trace string
+}
+
+func (m *rpcModule) Handle(e event.Event) error {
+	return nil
+}
+
+func (m *rpcModule) Name() string {
+	return "rpcModule"
+}
+
+func (m *rpcModule) Events() []string {
+	return nil
+}
+
+func (m *rpcModule) Echo5001(ctx context.Context, channel Channel, req *Req) (int, *Res, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return 0, nil, NewError(1, "deadline not propagated")
+	}
+	m.trace = ctx.Value(CtxKeyHeader).(map[string]string)[HeaderTraceId]
+	return 5002, &Res{Pong: req.Ping}, nil
+}
+
+// rpcLoopChannel deliver request to handlers of router, and responses back to rpc connection
+type rpcLoopChannel struct {
+	mockChannel
+	router Router
+	conn   *rpcConn
+	down   bool
+}
+
+func (c *rpcLoopChannel) Send(msg interface{}) error {
+	if c.down {
+		return errors.New("broken pipe")
+	}
+	req := proto.Clone(msg.(*message.ProtocolMessage)).(*message.ProtocolMessage)
+	go func() {
+		ctx := context.WithValue(context.Background(), CtxKeyHeader, req.GetHeader())
+		res := &mockChannel{ctx: ctx}
+		if req.GetRoute() == 5003 { // response encoded by codec of server link
+			res.sent = append(res.sent, &message.ProtocolMessage{Seq: req.GetSeq(), Route: 5004, Codec: message.Codec_SERVER, Payload: []byte{1}})
+		}
+		c.router.(*handlerManager).invokeHandler(ctx, res, req)
+		for _, m := range res.sent {
+			_ = c.conn.OnMessage(ctx, c, m)
+		}
+	}()
+	return nil
+}
+
+func TestRpcInvoke(t *testing.T) {
+	m, r := &rpcModule{}, NewRouter()
+	assert.Nil(t, r.RegisterModule(m))
+	d := NewStaticDiscovery(Instance{Service: "guild", Address: "a", Healthy: true}, Instance{Service: "guild", Address: "b", Healthy: true})
+	c := NewRpcClient(d, WithRpcPoolSize(1), WithIdempotentRoutes(1, 5001, 5003, 5999))
+	defer c.Close()
+	s, err := c.service("guild")
+	assert.Nil(t, err)
+	// instance b is down, calls picked it are retried on a
+	for addr, pool := range s.pools {
+		conn := &rpcConn{pool: pool}
+		conn.channel = &rpcLoopChannel{router: r, conn: conn, down: addr == "b"}
+		pool.conns = []*rpcConn{conn}
+	}
+	SetRpcClient(c)
+	ctx := context.WithValue(context.Background(), CtxKeyHeader, map[string]string{HeaderTraceId: "t-1"})
+	for i := 0; i < 5; i++ {
+		res, err := Invoke[Res](ctx, "guild", 5001, &Req{Ping: i})
+		assert.Nil(t, err)
+		assert.Equal(t, i, res.Pong)
+	}
+	assert.Equal(t, "t-1", m.trace)
+	// error response
+	_, err = Invoke[Res](ctx, "guild", 5999, &Req{})
+	var e *Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, ErrCodeRouteNotFound, e.Code)
+	}
+	// response encoded by codec of server link
+	_, err = Invoke[Res](ctx, "guild", 5003, &Req{})
+	assert.ErrorContains(t, err, "not supported")
+	// deadline
+	tCtx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = Invoke[Res](tCtx, "guild", 5001, &Req{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// no instance
+	d.Update("guild", nil)
+	_, err = Invoke[Res](ctx, "guild", 5001, &Req{})
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, ErrCodeServiceUnavailable, e.Code)
+}
+
+func TestRpcDialWithoutLock(t *testing.T) {
+	// instance accepts but never finishes tls handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	c := NewRpcClient(NewStaticDiscovery(), WithRpcPoolSize(2), WithRpcTLS(&tls.Config{InsecureSkipVerify: true}))
+	defer c.Close()
+	pool := &rpcPool{client: c, ins: Instance{Address: ln.Addr().String()}, dialed: make(chan struct{})}
+	conn := &rpcConn{pool: pool, channel: &mockChannel{ctx: context.Background()}}
+	pool.conns = []*rpcConn{conn}
+	dialing := make(chan struct{})
+	go func() {
+		defer close(dialing)
+		_, _ = pool.get(context.Background())
+	}()
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.dialing == 1
+	}, time.Second, time.Millisecond)
+	// callers use existing connection while dialing
+	ts := time.Now()
+	got, err := pool.get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, conn, got)
+	assert.Less(t, time.Since(ts), 100*time.Millisecond)
+	<-dialing
+}
@@ -0,0 +1,141 @@
+package smart
+
+import (
+	"context"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// channelTimers timers and close hooks of channel, it outlives pooled channel so timers fired late know the channel closed
+type channelTimers struct {
+	lock   sync.Mutex
+	closed bool
+	timers []*Timer
+	hooks  []func()
+}
+
+func (ct *channelTimers) isClosed() bool {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	return ct.closed
+}
+
+// track timer to cancel it on close, canceled ones are forgotten
+func (ct *channelTimers) track(t *Timer) *Timer {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if ct.closed {
+		t.Cancel()
+		return t
+	}
+	timers := ct.timers[:0]
+	for _, tt := range ct.timers {
+		if !tt.Canceled() {
+			timers = append(timers, tt)
+		}
+	}
+	ct.timers = append(timers, t)
+	return t
+}
+
+func (ct *channelTimers) close() {
+	ct.lock.Lock()
+	ct.closed = true
+	for _, t := range ct.timers {
+		t.Cancel()
+	}
+	hooks := ct.hooks
+	ct.timers, ct.hooks = nil, nil
+	ct.lock.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// whenClosed call hook once channel closed, at once if already closed
+func (h *defaultChannel) whenClosed(hook func()) {
+	ct := h.channelTimers()
+	ct.lock.Lock()
+	if !ct.closed {
+		ct.hooks = append(ct.hooks, hook)
+		ct.lock.Unlock()
+		return
+	}
+	ct.lock.Unlock()
+	hook()
+}
+
+// channelTimers of channel, created on first use
+func (h *defaultChannel) channelTimers() *channelTimers {
+	if ct := h.timers.Load(); ct != nil {
+		return ct
+	}
+	h.timers.CompareAndSwap(nil, &channelTimers{})
+	return h.timers.Load()
+}
+
+// onWorker run task on worker of channel unless channel closed
+func (h *defaultChannel) onWorker(ct *channelTimers, task func()) func() {
+	return func() {
+		if ct.isClosed() {
+			return
+		}
+		h.LaterRun(func() {
+			if !ct.isClosed() {
+				task()
+			}
+		})
+	}
+}
+
+// Schedule run task on worker of channel after delay, so it never races with handlers of channel.
+// timer is canceled when channel closed.
+func (h *defaultChannel) Schedule(delay time.Duration, task func()) *Timer {
+	ct := h.channelTimers()
+	return ct.track(defaultTimerWheel.AfterFunc(delay, h.onWorker(ct, task)))
+}
+
+// ScheduleAtFixedRate run task on worker of channel after delay, then every period.
+// timer is canceled when channel closed.
+func (h *defaultChannel) ScheduleAtFixedRate(delay, period time.Duration, task func()) *Timer {
+	ct := h.channelTimers()
+	return ct.track(defaultTimerWheel.Every(delay, period, h.onWorker(ct, task)))
+}
+
+// Cron run job at times of cron expression on a worker of server, e.g. "0 5 * * *" for daily reset at 05:00 of server time.
+// job with the same spec always runs on the same worker, the run is skipped if queue of worker is full.
+// jobs are canceled on Shutdown.
+func (s *baseServer) Cron(spec string, job func(ctx context.Context)) (*Timer, error) {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	t := defaultTimerWheel.Cron(cron, func() {
+		if s.loadStatus() != running {
+			logk.Warn("server not running, skip cron job", zap.String("cron", spec))
+			return
+		}
+		ctx := s.ctx
+		if err := s.workerManager.PickKey(spec).TryRun(ctx, func() {
+			job(ctx)
+		}); err != nil {
+			logk.Warn("worker queue is full, skip cron job", zap.String("cron", spec))
+		}
+	})
+	s.cronLock.Lock()
+	defer s.cronLock.Unlock()
+	s.crons = append(s.crons, t)
+	return t, nil
+}
+
+// cancelCrons cancel all cron jobs of server
+func (s *baseServer) cancelCrons() {
+	s.cronLock.Lock()
+	defer s.cronLock.Unlock()
+	for _, t := range s.crons {
+		t.Cancel()
+	}
+	s.crons = nil
+}
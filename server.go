@@ -2,6 +2,8 @@ package smart
 
 import (
 	"context"
+	"crypto/tls"
+	stderrors "errors"
 	"gitee.com/ywengineer/smart-kit/pkg/loaders"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart-kit/pkg/utilk"
@@ -11,6 +13,7 @@ import (
 	"go.uber.org/zap"
 	"net"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -22,13 +25,43 @@ type status int32
 const (
 	prepared status = iota
 	running
-	stopping
+	stopping // new channels are refused
+	draining // input of channels is discarded
 	stopped
 )
 
+// ShutdownPhase phases of Server.Shutdown, in order
+type ShutdownPhase int
+
+const (
+	// PhaseStopAccepting new channels are closed once opened
+	PhaseStopAccepting ShutdownPhase = iota
+	// PhaseNotifyClients shutdown message is sent to all channels
+	PhaseNotifyClients
+	// PhaseStopReading input of channels is discarded
+	PhaseStopReading
+	// PhaseDrainTasks wait for in-flight tasks of workers until deadline of shutdown context
+	PhaseDrainTasks
+	// PhaseStopModules stop hooks of modules are called
+	PhaseStopModules
+	// PhaseCloseListeners listeners and channels are closed
+	PhaseCloseListeners
+	// PhaseStopped server stopped
+	PhaseStopped
+)
+
+var shutdownPhaseNames = [...]string{"stop-accepting", "notify-clients", "stop-reading", "drain-tasks", "stop-modules", "close-listeners", "stopped"}
+
+func (p ShutdownPhase) String() string {
+	if p < 0 || int(p) >= len(shutdownPhaseNames) {
+		return "unknown"
+	}
+	return shutdownPhaseNames[p]
+}
+
 type serverHolder interface {
 	onSpin() error
-	onShutdown() error
+	onShutdown(ctx context.Context) error
 }
 
 // Server smart server interface
@@ -38,12 +71,39 @@ type Server interface {
 	ConnCount() int32
 	GetChannel(id int) (Channel, bool)
 	SetOnConfigChange(callback func(conf loaders.Conf))
+	// WatchConfig call watch with raw config whenever config of loader changed, after SetOnConfigChange callback,
+	// e.g. sections of config unknown to server. loader is watched by server only, since some loaders keep one watcher only.
+	WatchConfig(watch func(data string, loader loaders.SmartLoader) error)
 	SetOnTick(tick func(ctx context.Context) time.Duration)
+	// SetRouter set router of server before Serve, DefaultRouter is used if not set.
+	// modules of router are started on Serve and stopped on Shutdown
+	SetRouter(r Router)
+	Router() Router
+	// UseRouter add router used by channels of server besides the one of server before Serve,
+	// e.g. attached to channels of a listener by WithRouter. modules of it are started and stopped along with router of server.
+	// channel with router not used by server is refused.
+	UseRouter(r Router) error
+	// Workers of server, e.g. bound queues of workers or collect metrics of them
+	Workers() WorkerManager
+	// SetOnShutdown hook called when Shutdown enters each phase
+	SetOnShutdown(hook func(phase ShutdownPhase))
+	// Cron run job at times of cron expression on a worker of server, see CronSchedule
+	Cron(spec string, job func(ctx context.Context)) (*Timer, error)
+	// Listen add listener before Serve besides the one of conf, channels accepted by it are initialized by initializers.
+	// listeners share workers and router of server, e.g. internal port for services or unix socket for local tools.
+	Listen(network, address string, initializers ...ChannelInitializer) error
+	// ListenTLS Listen over tls, see TLSConfig.ServerConfig.
+	// crypto/tls needs blocking conn, so channels over tls are not served by event loops of netpoll or gnet
+	// but by a goroutine each, behind pkg.Conn as well. socket options of gnet except multicore are applied to them.
+	ListenTLS(network, address string, conf *tls.Config, initializers ...ChannelInitializer) error
+	// SetTLS serve listener of conf over tls before Serve, see ListenTLS
+	SetTLS(conf *tls.Config) error
 }
 
 type defaultServer struct {
 	*baseServer
-	eventLoop netpoll.EventLoop
+	loopLock   sync.Mutex
+	eventLoops []netpoll.EventLoop
 }
 
 func _newServer(loader loaders.SmartLoader, useGNet bool, initializer ...ChannelInitializer) (Server, error) {
@@ -57,7 +117,8 @@ func _newServer(loader loaders.SmartLoader, useGNet bool, initializer ...Channel
 	} else {
 		logk.CtxDebugf(logk.With(conf), "new smart server with conf")
 	}
-	worker := NewWorkerManager(utilk.MaxInt(conf.Workers, 0), parseLoadBalance(conf.WorkerLoadBalance))
+	lb, weights := parseLoadBalance(conf.WorkerLoadBalance)
+	worker := NewWorkerManager(utilk.MaxInt(conf.Workers, 0), lb, weights...)
 	if useGNet {
 		srv := &gnetServer{
 			baseServer: &baseServer{
@@ -66,6 +127,7 @@ func _newServer(loader loaders.SmartLoader, useGNet bool, initializer ...Channel
 				initializers:  initializer,
 				conf:          conf,
 				confLoader:    loader,
+				router:        hManager,
 			},
 		}
 		srv.baseServer.holder = srv
@@ -78,6 +140,7 @@ func _newServer(loader loaders.SmartLoader, useGNet bool, initializer ...Channel
 				initializers:  initializer,
 				conf:          conf,
 				confLoader:    loader,
+				router:        hManager,
 			},
 		}
 		srv.baseServer.holder = srv
@@ -85,6 +148,7 @@ func _newServer(loader loaders.SmartLoader, useGNet bool, initializer ...Channel
 	}
 }
 
+// NewGNetServer server on event loops of gnet, note that gnet lower cases address of listener, so path of unix socket should be in lower case.
 func NewGNetServer(loader loaders.SmartLoader, initializer ...ChannelInitializer) (Server, error) {
 	return _newServer(loader, true, initializer...)
 }
@@ -94,23 +158,44 @@ func NewSmartServer(loader loaders.SmartLoader, initializer ...ChannelInitialize
 }
 
 func (s *defaultServer) onSpin() error {
-	var listener net.Listener
-	var err error
-	if goos := runtime.GOOS; goos == "windows" {
-		if listener, err = net.Listen(s.conf.Network, s.conf.Address); err != nil {
-			logk.Fatal("create server listener on windows error", zap.Error(err))
+	listeners := s.allListeners()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		if l.tls != nil {
+			go func() {
+				errs <- s.serveTLS(l, nil)
+			}()
+			continue
+		}
+		var ln net.Listener
+		var err error
+		if goos := runtime.GOOS; goos == "windows" {
+			if ln, err = net.Listen(l.network, l.address); err != nil {
+				logk.Fatal("create server listener on windows error", zap.Stringer("listener", l), zap.Error(err))
+			}
+		} else if ln, err = netpoll.CreateListener(l.network, l.address); err != nil {
+			logk.Fatal("create server listener error", zap.Stringer("listener", l), zap.Error(err))
 		}
-	} else if listener, err = netpoll.CreateListener(s.conf.Network, s.conf.Address); err != nil {
-		logk.Fatal("create server listener error", zap.Error(err))
+		eventLoop, _ := netpoll.NewEventLoop(s.onConnRead, netpoll.WithOnPrepare(s.onConnPrepare), netpoll.WithOnConnect(s.onConnOpen(l.initializers)))
+		s.loopLock.Lock()
+		s.eventLoops = append(s.eventLoops, eventLoop)
+		s.loopLock.Unlock()
+		go func() {
+			errs <- eventLoop.Serve(ln)
+		}()
 	}
-	eventLoop, _ := netpoll.NewEventLoop(s.onConnRead, netpoll.WithOnPrepare(s.onConnPrepare), netpoll.WithOnConnect(s.onConnOpen))
-	s.eventLoop = eventLoop
-	//
-	return s.eventLoop.Serve(listener)
+	// serve quit once any listener quit
+	return <-errs
 }
 
-func (s *defaultServer) onShutdown() error {
-	return s.eventLoop.Shutdown(s.ctx)
+func (s *defaultServer) onShutdown(ctx context.Context) error {
+	s.loopLock.Lock()
+	defer s.loopLock.Unlock()
+	var errs []error
+	for _, eventLoop := range s.eventLoops {
+		errs = append(errs, eventLoop.Shutdown(ctx))
+	}
+	return stderrors.Join(errs...)
 }
 
 func (s *defaultServer) onConnPrepare(conn netpoll.Connection) context.Context {
@@ -129,10 +214,13 @@ func (s *defaultServer) onConnRead(_ context.Context, conn netpoll.Connection) e
 	return nil
 }
 
-func (s *defaultServer) onConnOpen(_ context.Context, conn netpoll.Connection) context.Context {
-	_ = conn.AddCloseCallback(s.onConnClosed)
-	s.onChannelOpen(pkg.NetNetpollConn(conn))
-	return s.ctx
+// onConnOpen open channels accepted by listener with initializers
+func (s *defaultServer) onConnOpen(initializers []ChannelInitializer) netpoll.OnConnect {
+	return func(_ context.Context, conn netpoll.Connection) context.Context {
+		_ = conn.AddCloseCallback(s.onConnClosed)
+		s.onChannelOpen(pkg.NetNetpollConn(conn), initializers)
+		return s.ctx
+	}
 }
 
 func (s *defaultServer) onConnClosed(conn netpoll.Connection) error {
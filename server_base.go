@@ -2,7 +2,9 @@ package smart
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	stderrors "errors"
 	"gitee.com/ywengineer/smart-kit/pkg/loaders"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart/codec"
@@ -11,6 +13,8 @@ import (
 	"github.com/go-spring/spring-core/gs"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,13 +35,24 @@ type baseServer struct {
 	channels       sync.Map // key=fd, value=connection
 	channelCount   int32    // accept counter
 	initializers   []ChannelInitializer
+	listeners      []listener // extra listeners, see Listen
 	workerManager  WorkerManager
 	conf           *loaders.Conf
 	confLoader     loaders.SmartLoader
 	onConfigChange func(conf loaders.Conf)
+	configWatchers []func(data string, loader loaders.SmartLoader) error // guarded by lock, see WatchConfig
 	ctx            context.Context
 	shutdownHook   context.CancelFunc
 	onTick         func(ctx context.Context) time.Duration
+	onShutdown     func(phase ShutdownPhase)
+	router         *handlerManager
+	routers        []*handlerManager // extra routers, see UseRouter
+	cronLock       sync.Mutex
+	crons          []*Timer
+	tlsConf        *tls.Config // tls of listener of conf, see SetTLS
+	tlsLock        sync.Mutex
+	tlsListeners   []net.Listener
+	tlsConns       sync.Map // key=*pkg.TLSConn
 }
 
 func (s *baseServer) ticker() {
@@ -53,7 +68,7 @@ func (s *baseServer) ticker() {
 			timer.Stop()
 		}
 		if p := recover(); p != nil {
-			if s.status == running {
+			if s.loadStatus() == running {
 				logk.Error("panic on server tick, restart it.", zap.Any("recover", p))
 				go s.ticker()
 			} else {
@@ -68,7 +83,7 @@ func (s *baseServer) ticker() {
 		} else {
 			timer.Reset(delay)
 		}
-		if s.status > running { // not running
+		if s.loadStatus() > running { // not running
 			logk.Infof("server will be shutdown soon. disable heartbeat")
 			break
 		}
@@ -84,8 +99,8 @@ func (s *baseServer) onChannelRead(fd int) error {
 	// channel not registered
 	if channel, ok := s.channels.Load(fd); ok == false {
 		return ErrNotRegisteredChannel
-	} else if s.status == stopping || s.status == stopped {
-		_ = channel.(*defaultChannel).Send(closedMsg)
+	} else if s.loadStatus() >= draining {
+		channel.(*defaultChannel).discard()
 		return ErrServerStopped
 	} else { // registered
 		return channel.(*defaultChannel).onMessageRead()
@@ -100,12 +115,14 @@ func (s *baseServer) onChannelClosed(fd int) error {
 	return nil
 }
 
-func (s *baseServer) onChannelOpen(conn pkg.Conn) {
+// onChannelOpen returns channel opened, nil if server not running
+func (s *baseServer) onChannelOpen(conn pkg.Conn, initializers []ChannelInitializer) *defaultChannel {
 	channel := channelPool.Get().(*defaultChannel)
+	*channel = defaultChannel{} // reset pooled channel
 	channel.ctx = context.WithValue(s.ctx, CtxKeyFromClient, conn.Fd())
-	channel.conn, channel.fd = conn, conn.Fd()
-	channel.worker = s.workerManager.Pick(channel.fd)
-	for _, initializer := range s.initializers {
+	channel.conn, channel.fd, channel.router = conn, conn.Fd(), s.router
+	channel.worker, channel.workers = s.workerManager.Pick(channel.fd), s.workerManager
+	for _, initializer := range initializers {
 		initializer(channel)
 	}
 	// check byte order
@@ -118,14 +135,20 @@ func (s *baseServer) onChannelOpen(conn pkg.Conn) {
 		channel.codec = codec.Byte()
 		logk.Warn("codec not set, default is byte")
 	}
-	if s.status == running {
+	if !slices.Contains(s.allRouters(), channel.router) {
+		logk.Error("router of channel is not used by server, see Server.UseRouter", zap.Int("fd", channel.fd))
+		_ = channel.Close()
+		return nil
+	}
+	if s.loadStatus() == running {
 		s.channels.Store(channel.fd, channel)
 		atomic.AddInt32(&s.channelCount, 1)
 		channel.onOpen()
-	} else {
-		_ = channel.Send(closedMsg)
-		_ = channel.Close()
+		return channel
 	}
+	_ = channel.Send(closedMsg)
+	_ = channel.Close()
+	return nil
 }
 
 func (s *baseServer) ConnCount() int32 {
@@ -140,47 +163,178 @@ func (s *baseServer) GetChannel(id int) (Channel, bool) {
 	return nil, false
 }
 
+// listener accepts channels on network address, initialized by initializers
+type listener struct {
+	network, address string
+	initializers     []ChannelInitializer
+	tls              *tls.Config // nil means plain
+}
+
+func (l listener) String() string {
+	return l.network + "://" + l.address
+}
+
+func (s *baseServer) Listen(network, address string, initializers ...ChannelInitializer) error {
+	return s.ListenTLS(network, address, nil, initializers...)
+}
+
+func (s *baseServer) ListenTLS(network, address string, conf *tls.Config, initializers ...ChannelInitializer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.loadStatus() != prepared {
+		return errors.New("listen must be called before serve")
+	}
+	if len(initializers) == 0 {
+		return errors.New("initializer of channel can not be empty")
+	}
+	s.listeners = append(s.listeners, listener{network: network, address: address, initializers: initializers, tls: conf})
+	return nil
+}
+
+func (s *baseServer) SetTLS(conf *tls.Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.loadStatus() != prepared {
+		return errors.New("tls must be set before serve")
+	}
+	s.tlsConf = conf
+	return nil
+}
+
+// allListeners listener of conf with initializers of server first, then extra ones
+func (s *baseServer) allListeners() []listener {
+	return append([]listener{{network: s.conf.Network, address: s.conf.Address, initializers: s.initializers, tls: s.tlsConf}}, s.listeners...)
+}
+
 func (s *baseServer) SetOnConfigChange(callback func(conf loaders.Conf)) {
 	s.onConfigChange = callback
 }
 
+func (s *baseServer) WatchConfig(watch func(data string, loader loaders.SmartLoader) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.configWatchers = append(s.configWatchers, watch)
+}
+
+func (s *baseServer) SetRouter(r Router) {
+	s.router = r.(*handlerManager)
+}
+
+func (s *baseServer) Router() Router {
+	return s.router
+}
+
+func (s *baseServer) UseRouter(r Router) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.loadStatus() != prepared {
+		return errors.New("router must be used before serve")
+	}
+	if hm := r.(*handlerManager); !slices.Contains(s.routers, hm) {
+		s.routers = append(s.routers, hm)
+	}
+	return nil
+}
+
+// allRouters router of server first, then extra ones
+func (s *baseServer) allRouters() []*handlerManager {
+	routers := []*handlerManager{s.router}
+	for _, r := range s.routers {
+		if r != s.router {
+			routers = append(routers, r)
+		}
+	}
+	return routers
+}
+
+func (s *baseServer) Workers() WorkerManager {
+	return s.workerManager
+}
+
 func (s *baseServer) SetOnTick(tick func(ctx context.Context) time.Duration) {
 	s.onTick = tick
 }
 
+// Shutdown stop server gracefully, see ShutdownPhase. tasks in-flight are waited until deadline of ctx,
+// 10 minutes at most if ctx has no deadline. stopping modules and closing listeners have ModuleStopGrace
+// each if less time of ctx left.
 func (s *baseServer) Shutdown(ctx context.Context) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if s.status != running {
+	if s.loadStatus() != running {
 		return errors.New("mr. smart server is not prepared or already stopped")
 	}
-	// can not start again.
-	s.status = stopping
 	ts := time.Now()
-	tick := time.NewTicker(time.Second)
-	tickCycle := 0
-loop:
-	for {
+	// can not start again.
+	s.enterPhase(PhaseStopAccepting)
+	s.storeStatus(stopping)
+	s.cancelCrons()
+	s.enterPhase(PhaseNotifyClients)
+	s.channels.Range(func(key, value interface{}) bool {
+		_ = value.(*defaultChannel).Send(closedMsg)
+		return true
+	})
+	s.enterPhase(PhaseStopReading)
+	s.storeStatus(draining)
+	s.enterPhase(PhaseDrainTasks)
+	if err := s.drain(ctx); err != nil {
+		logk.Warn("wait for in-flight tasks exceed the deadline", zap.Int("pending", s.workerManager.Pending()), zap.Error(err))
+	}
+	// flush modules before server context canceled, with time of their own even if drain used up ctx
+	s.enterPhase(PhaseStopModules)
+	stopCtx, cancel := graceContext(ctx)
+	routers := s.allRouters()
+	for idx := len(routers) - 1; idx >= 0; idx-- {
+		routers[idx].stop(stopCtx)
+	}
+	cancel()
+	s.enterPhase(PhaseCloseListeners)
+	closeCtx, cancel := graceContext(ctx)
+	defer cancel()
+	err := stderrors.Join(s.holder.onShutdown(closeCtx), s.closeTLS())
+	s.shutdownHook()
+	s.storeStatus(stopped)
+	s.enterPhase(PhaseStopped)
+	logk.Infof("server stopped, cost: %s", time.Since(ts))
+	return err
+}
+
+// drain wait for in-flight tasks of workers to finish
+func (s *baseServer) drain(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Minute)
+		defer cancel()
+	}
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for s.workerManager.Pending() > 0 {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-tick.C:
-			if s.workerManager.RunningWorker() > 0 {
-				if tickCycle >= 600 {
-					logk.Warnf("wait for finish all task exceed the deadline 10M, running worker: %d", s.workerManager.RunningWorker())
-					break loop
-				}
-				tickCycle++
-				logk.Info("wait for all task to finish.")
-			} else {
-				break loop
-			}
 		}
 	}
-	tick.Stop()
-	logk.Infof("server stopped, cost: %s", time.Since(ts))
-	s.shutdownHook()
-	s.status = stopped
-	// close all channels
-	return s.holder.onShutdown()
+	return nil
+}
+
+func (s *baseServer) enterPhase(phase ShutdownPhase) {
+	logk.Info("server shutdown", zap.Stringer("phase", phase), zap.Int32("channels", s.ConnCount()), zap.Int("pending", s.workerManager.Pending()))
+	if s.onShutdown != nil {
+		s.onShutdown(phase)
+	}
+}
+
+func (s *baseServer) SetOnShutdown(hook func(phase ShutdownPhase)) {
+	s.onShutdown = hook
+}
+
+func (s *baseServer) loadStatus() status {
+	return status(atomic.LoadInt32((*int32)(&s.status)))
+}
+
+func (s *baseServer) storeStatus(st status) {
+	atomic.StoreInt32((*int32)(&s.status), int32(st))
 }
 
 func (s *baseServer) ListenAndServe(sig gs.ReadySignal) error {
@@ -193,18 +347,35 @@ func (s *baseServer) ListenAndServe(sig gs.ReadySignal) error {
 func (s *baseServer) Serve(ctx context.Context) (context.Context, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if s.status != prepared {
+	if s.loadStatus() != prepared {
 		return nil, errors.New("start smart server failed. maybe already started or can not start again")
 	}
 	s.ctx, s.shutdownHook = context.WithCancel(ctx)
-	//
-	s.status = running
-	//
 	s.ctx = context.WithValue(s.ctx, CtxKeyService, s.conf.ServiceName)
+	// init and start modules before accepting channels
+	var err error
+	routers := s.allRouters()
+	for idx, r := range routers {
+		if err = r.start(s.ctx); err != nil {
+			for idx--; idx >= 0; idx-- {
+				routers[idx].stop(s.ctx)
+			}
+			break
+		}
+	}
+	if err != nil {
+		s.shutdownHook()
+		s.storeStatus(stopped)
+		return nil, errors.WithMessage(err, "start smart server failed")
+	}
+	//
+	s.storeStatus(running)
 	// start listen loop ...
 	go func() {
 		//
-		logk.Infof("serve run at: %s", s.conf.Network+"://"+s.conf.Address)
+		for _, l := range s.allListeners() {
+			logk.Infof("serve run at: %s", l)
+		}
 		//
 		if err := s.holder.onSpin(); err != nil {
 			logk.Fatal("serve listener error", zap.Error(err))
@@ -215,16 +386,28 @@ func (s *baseServer) Serve(ctx context.Context) (context.Context, error) {
 	// tick
 	go s.ticker()
 	// watch config
-	if err := s.confLoader.Watch(s.ctx, func(conf string) error {
+	if err = s.confLoader.Watch(s.ctx, func(conf string) error {
+		workers, workerLB := s.conf.Workers, s.conf.WorkerLoadBalance
 		if err := s.confLoader.Unmarshal([]byte(conf), s.conf); err != nil {
 			logk.Error("unmarshal configuration when watch", zap.Error(err))
 			return err
 		}
 		logk.CtxDebugf(logk.With(s.conf), "server config changed")
+		if workers != s.conf.Workers || workerLB != s.conf.WorkerLoadBalance {
+			lb, weights := parseLoadBalance(s.conf.WorkerLoadBalance)
+			s.workerManager.Resize(s.conf.Workers, lb, weights...)
+		}
 		if s.onConfigChange != nil {
 			s.onConfigChange(*s.conf)
 		}
-		return nil
+		s.lock.Lock()
+		watchers := s.configWatchers
+		s.lock.Unlock()
+		var errs []error
+		for _, watch := range watchers {
+			errs = append(errs, watch(conf, s.confLoader))
+		}
+		return stderrors.Join(errs...)
 	}); err != nil {
 		logk.Error("server config watcher start error", zap.Error(err))
 	} else {
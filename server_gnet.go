@@ -1,31 +1,57 @@
 package smart
 
 import (
-	"fmt"
+	"context"
+	stderrors "errors"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"gitee.com/ywengineer/smart/pkg"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	gnetRecvBuffer = 1 * 1024 * 1024
+	gnetKeepAlive  = time.Minute
+)
+
+// tuneGNetConn socket options of gnet engines, applied to channels over tls served out of engines
+func tuneGNetConn(c *net.TCPConn) {
+	_ = c.SetNoDelay(true)
+	_ = c.SetReadBuffer(gnetRecvBuffer)
+	_ = c.SetKeepAlive(true)
+	_ = c.SetKeepAlivePeriod(gnetKeepAlive)
+}
+
 type gnetServer struct {
 	*baseServer
 	gnet.BuiltinEventEngine
-	eng          gnet.Engine
+	engineLock   sync.Mutex // guards engines, lock of baseServer is used by its own methods
+	engines      []*gnetListener
 	disconnected int32
 }
 
-func (s *gnetServer) OnBoot(eng gnet.Engine) (action gnet.Action) {
-	logk.Info("running server on " + fmt.Sprintf("%s://%s", s.conf.Network, s.conf.Address))
-	s.eng = eng
+// gnetListener engine of a listener, channels accepted are initialized by initializers of the listener
+type gnetListener struct {
+	*gnetServer
+	listener
+	eng gnet.Engine
+}
+
+func (l *gnetListener) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	logk.Info("running server on " + l.listener.String())
+	l.engineLock.Lock()
+	defer l.engineLock.Unlock()
+	l.eng = eng
 	return
 }
 
-func (s *gnetServer) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	s.onChannelOpen(pkg.NetGNetConn(c))
+func (l *gnetListener) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
+	l.onChannelOpen(pkg.NetGNetConn(c), l.initializers)
 	return
 }
 
@@ -50,15 +76,39 @@ func (s *gnetServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 }
 
 func (s *gnetServer) onSpin() error {
-	return gnet.Run(s, s.conf.Network+"://"+s.conf.Address,
-		gnet.WithMulticore(true),
-		gnet.WithTCPNoDelay(gnet.TCPNoDelay),
-		gnet.WithLogger(logk.DefaultLogger()),
-		gnet.WithSocketRecvBuffer(1*1024*1024),
-		gnet.WithTCPKeepAlive(time.Minute), // keep alive
-	)
+	listeners := s.allListeners()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		if l.tls != nil {
+			go func() {
+				errs <- s.serveTLS(l, tuneGNetConn)
+			}()
+			continue
+		}
+		gl := &gnetListener{gnetServer: s, listener: l}
+		s.engineLock.Lock()
+		s.engines = append(s.engines, gl)
+		s.engineLock.Unlock()
+		go func() {
+			errs <- gnet.Run(gl, l.String(),
+				gnet.WithMulticore(true),
+				gnet.WithTCPNoDelay(gnet.TCPNoDelay),
+				gnet.WithLogger(logk.DefaultLogger()),
+				gnet.WithSocketRecvBuffer(gnetRecvBuffer),
+				gnet.WithTCPKeepAlive(gnetKeepAlive), // keep alive
+			)
+		}()
+	}
+	// serve quit once any listener quit
+	return <-errs
 }
 
-func (s *gnetServer) onShutdown() error {
-	return s.eng.Stop(s.ctx)
+func (s *gnetServer) onShutdown(ctx context.Context) error {
+	s.engineLock.Lock()
+	defer s.engineLock.Unlock()
+	var errs []error
+	for _, gl := range s.engines {
+		errs = append(errs, gl.eng.Stop(ctx))
+	}
+	return stderrors.Join(errs...)
 }
@@ -9,6 +9,11 @@ import (
 	"gitee.com/ywengineer/smart/codec"
 	"gitee.com/ywengineer/smart/message"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -146,3 +151,169 @@ func runClient(t *testing.T, ctx context.Context, network, addr string, initiali
 		}
 	}()
 }
+
+type shutdownHolder struct {
+	closed bool
+	ctxErr error // error of ctx of onShutdown
+}
+
+func (h *shutdownHolder) onSpin() error {
+	return nil
+}
+
+func (h *shutdownHolder) onShutdown(ctx context.Context) error {
+	h.closed, h.ctxErr = true, ctx.Err()
+	return nil
+}
+
+// newTestBase server built by hand since loader is not available in tests, listener of conf on an ephemeral port.
+// set holder, then listen and spin it by spinTest
+func newTestBase(t *testing.T, initializers ...ChannelInitializer) *baseServer {
+	return &baseServer{
+		status: prepared, workerManager: NewWorkerManager(2, RoundRobin), router: NewRouter().(*handlerManager),
+		conf: &loader2.Conf{Network: "tcp", Address: freeAddr(t)}, initializers: initializers,
+	}
+}
+
+// spinTest run server as Serve does
+func spinTest(srv *baseServer) {
+	srv.ctx, srv.shutdownHook = context.WithCancel(context.Background())
+	srv.storeStatus(running)
+	go func() { _ = srv.holder.onSpin() }()
+}
+
+// freeAddr address of an ephemeral port on loopback
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialTest dial server until it is listening
+func dialTest(t *testing.T, network, address string) net.Conn {
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial(network, address)
+		return err == nil
+	}, time.Second, 10*time.Millisecond, address)
+	return conn
+}
+
+func TestServerUseRouter(t *testing.T) {
+	var started int32
+	admin := NewRouter()
+	m := &startedSwapModule{onStart: func(ctx context.Context) error {
+		atomic.AddInt32(&started, 1)
+		return nil
+	}}
+	assert.Nil(t, admin.RegisterModule(m))
+	base := newTestBase(t, func(channel Channel) {})
+	base.confLoader = loader2.NewValueLoader(base.conf)
+	srv := &defaultServer{baseServer: base}
+	base.holder = srv
+	adminAddr, otherAddr := freeAddr(t), freeAddr(t)
+	assert.Nil(t, srv.Listen("tcp", adminAddr, WithRouter(admin)))
+	assert.Nil(t, srv.Listen("tcp", otherAddr, WithRouter(NewRouter())))
+	assert.Nil(t, srv.UseRouter(admin))
+	_, err := srv.Serve(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&started))
+	assert.Error(t, srv.UseRouter(NewRouter()))
+	// channel with router not used by server is refused
+	defer dialTest(t, "tcp", adminAddr).Close()
+	other := dialTest(t, "tcp", otherAddr)
+	defer other.Close()
+	_ = other.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = other.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return srv.ConnCount() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.stopped))
+}
+
+func TestShutdownPhases(t *testing.T) {
+	holder := &shutdownHolder{}
+	srv := newTestBase(t)
+	srv.holder = holder
+	spinTest(srv)
+	var phases []ShutdownPhase
+	srv.SetOnShutdown(func(phase ShutdownPhase) {
+		phases = append(phases, phase)
+	})
+	// in-flight task is waited
+	done := int32(0)
+	srv.workerManager.Pick(0).Run(context.Background(), func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+	})
+	assert.Nil(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+	assert.Equal(t, []ShutdownPhase{PhaseStopAccepting, PhaseNotifyClients, PhaseStopReading, PhaseDrainTasks, PhaseStopModules, PhaseCloseListeners, PhaseStopped}, phases)
+	assert.True(t, holder.closed)
+	assert.Equal(t, "drain-tasks", PhaseDrainTasks.String())
+	assert.Error(t, srv.Shutdown(context.Background()))
+	// drain bounded by deadline, stopping modules and listeners have time of their own
+	holder = &shutdownHolder{}
+	srv = newTestBase(t)
+	srv.holder = holder
+	spinTest(srv)
+	assert.Nil(t, srv.router.start(context.Background()))
+	m := &startedSwapModule{}
+	assert.Nil(t, srv.router.RegisterModule(m))
+	release := make(chan struct{})
+	defer close(release)
+	srv.workerManager.Pick(0).Run(context.Background(), func() { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, srv.drain(ctx))
+	assert.Nil(t, srv.Shutdown(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.stopped))
+	assert.Nil(t, m.stopErr)
+	assert.True(t, holder.closed)
+	assert.Nil(t, holder.ctxErr)
+}
+
+func TestServerListen(t *testing.T) {
+	t.Run("netpoll", func(t *testing.T) {
+		testServerListen(t, func(base *baseServer) { base.holder = &defaultServer{baseServer: base} })
+	})
+	t.Run("gnet", func(t *testing.T) {
+		testServerListen(t, func(base *baseServer) { base.holder = &gnetServer{baseServer: base} })
+	})
+}
+
+// testServerListen serve on tcp of conf and an extra unix listener, with server set as holder of base by wrap
+func testServerListen(t *testing.T, wrap func(base *baseServer)) {
+	tag := func(name string) ChannelInitializer {
+		return func(channel Channel) { channel.SetAttachment(name) }
+	}
+	// gnet lower cases address, t.TempDir() is named after test
+	dir, err := os.MkdirTemp("", "smart")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "smart.sock")
+	srv := newTestBase(t, tag("public"))
+	wrap(srv)
+	assert.Nil(t, srv.Listen("unix", sock, tag("local")))
+	assert.Error(t, srv.Listen("tcp", freeAddr(t)))
+	spinTest(srv)
+	assert.Error(t, srv.Listen("tcp", freeAddr(t), tag("late")))
+	attachments := func() map[string]int {
+		tags := map[string]int{}
+		srv.channels.Range(func(key, value interface{}) bool {
+			tags[value.(Channel).GetAttachment().(string)]++
+			return true
+		})
+		return tags
+	}
+	for _, l := range []listener{{network: "tcp", address: srv.conf.Address}, {network: "unix", address: sock}} {
+		defer dialTest(t, l.network, l.address).Close()
+	}
+	assert.Eventually(t, func() bool {
+		tags := attachments()
+		return tags["public"] == 1 && tags["local"] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, srv.Shutdown(context.Background()))
+}
@@ -0,0 +1,103 @@
+package smart
+
+import (
+	"context"
+	"fmt"
+	"gitee.com/ywengineer/smart-kit/pkg/loaders"
+	"github.com/go-spring/spring-core/gs"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// SpringConf server config bound from go-spring properties, e.g. `value:"${smart}"`
+type SpringConf struct {
+	Network           string `value:"${network:=tcp}"`
+	Address           string `value:"${address:=:12345}"`
+	Workers           int    `value:"${workers:=0}"`
+	WorkerLoadBalance string `value:"${worker-load-balance:=rr}"`
+	ServiceName       string `value:"${service-name:=smart}"`
+	GNet              bool   `value:"${gnet:=false}"`
+}
+
+// springServer smart server exposed as go-spring server bean.
+// all Module beans are registered to router of server, then modules are started/stopped with server.
+type springServer struct {
+	Conf         SpringConf `value:"${smart}"`
+	Modules      []Module   `autowire:"*?"`
+	initializers []ChannelInitializer
+	server       Server
+}
+
+// SpringServer declare smart server as go-spring server bean, config is bound from properties with prefix "smart".
+// modules declared by SpringModule are injected and registered before serving.
+func SpringServer(initializers ...ChannelInitializer) {
+	gs.Object(&springServer{initializers: initializers}).Init((*springServer).init).AsServer()
+}
+
+// SpringModule declare module as go-spring bean, fields of module tagged with `autowire` or `value`
+// (stores, other modules, config values) are injected before it registered to server.
+// it panics if module of the same name already declared, like duplicated bean of go-spring.
+func SpringModule(module Module, opts ...ModuleOption) {
+	springModules.lock.Lock()
+	defer springModules.lock.Unlock()
+	if _, ok := springModules.opts[module.Name()]; ok {
+		panic(fmt.Sprintf("spring module [%s] already declared", module.Name()))
+	}
+	springModules.opts[module.Name()] = opts
+	gs.Object(module).Export(gs.As[Module]())
+}
+
+// springModules options of modules declared by SpringModule, key is module name
+var springModules = struct {
+	lock sync.Mutex
+	opts map[string][]ModuleOption
+}{opts: map[string][]ModuleOption{}}
+
+// springModuleOpts options of module declared by SpringModule
+func springModuleOpts(name string) []ModuleOption {
+	springModules.lock.Lock()
+	defer springModules.lock.Unlock()
+	return springModules.opts[name]
+}
+
+func (s *springServer) init() (err error) {
+	loader := loaders.NewValueLoader(&loaders.Conf{
+		Network:           s.Conf.Network,
+		Address:           s.Conf.Address,
+		Workers:           s.Conf.Workers,
+		WorkerLoadBalance: s.Conf.WorkerLoadBalance,
+		ServiceName:       s.Conf.ServiceName,
+	})
+	if s.Conf.GNet {
+		s.server, err = NewGNetServer(loader, s.initializers...)
+	} else {
+		s.server, err = NewSmartServer(loader, s.initializers...)
+	}
+	if err != nil {
+		return errors.WithMessage(err, "create spring smart server")
+	}
+	// modules share a router owned by server, so multiple spring servers do not share routes
+	router := NewRouter()
+	for _, m := range s.Modules {
+		if err = router.RegisterModule(m, springModuleOpts(m.Name())...); err != nil {
+			return errors.WithMessage(err, "register spring module: "+m.Name())
+		}
+	}
+	s.server.SetRouter(router)
+	return nil
+}
+
+// Server returns the smart server created by go-spring
+func (s *springServer) Server() Server {
+	return s.server
+}
+
+func (s *springServer) ListenAndServe(sig gs.ReadySignal) error {
+	return s.server.(interface {
+		ListenAndServe(sig gs.ReadySignal) error
+	}).ListenAndServe(sig)
+}
+
+func (s *springServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
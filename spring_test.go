@@ -0,0 +1,48 @@
+package smart
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+)
+
+type readySignal chan struct{}
+
+func (s readySignal) TriggerAndWait() <-chan struct{} { return s }
+
+func TestSpringServer(t *testing.T) {
+	var started int32
+	m := &startedSwapModule{onStart: func(ctx context.Context) error {
+		atomic.AddInt32(&started, 1)
+		return nil
+	}}
+	SpringModule(m, WithDispatchKey(3001, KeyFromHeader("room")))
+	defer func() {
+		springModules.lock.Lock()
+		delete(springModules.opts, m.Name())
+		springModules.lock.Unlock()
+	}()
+	assert.Panics(t, func() { SpringModule(&swapModule{}) })
+	// as go-spring injects config and module beans, then inits server bean
+	s := &springServer{
+		Conf:         SpringConf{Network: "tcp", Address: freeAddr(t), ServiceName: "spring"},
+		Modules:      []Module{m},
+		initializers: []ChannelInitializer{func(channel Channel) {}},
+	}
+	assert.Nil(t, s.init())
+	hd := s.Server().Router().(*handlerManager).findHandlerDefinition(3001)
+	if assert.NotNil(t, hd) {
+		assert.NotNil(t, hd.dispatch)
+	}
+	// server lifecycle driven by go-spring
+	sig := make(readySignal)
+	served := make(chan error)
+	go func() { served <- s.ListenAndServe(sig) }()
+	defer dialTest(t, s.Conf.Network, s.Conf.Address).Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&started))
+	close(sig)
+	assert.Nil(t, <-served)
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.stopped))
+}
@@ -0,0 +1,193 @@
+package smart
+
+import (
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5 // 64^5 ticks, about 124 days with tick of 10ms
+
+	// DefaultTimerTick precision of timers of channels and servers
+	DefaultTimerTick = 10 * time.Millisecond
+)
+
+// Timer handle of task scheduled on TimerWheel
+type Timer struct {
+	expire   uint64 // tick to fire
+	period   uint64 // ticks between runs of fixed rate timer, 0 means one shot
+	cron     *CronSchedule
+	task     func()
+	canceled int32
+	next     *Timer // next timer in slot
+}
+
+// Cancel stop timer, returns false if timer already canceled or one shot timer already fired
+func (t *Timer) Cancel() bool {
+	return atomic.CompareAndSwapInt32(&t.canceled, 0, 1)
+}
+
+// Canceled timer is canceled or one shot timer fired
+func (t *Timer) Canceled() bool {
+	return atomic.LoadInt32(&t.canceled) == 1
+}
+
+// TimerWheel hierarchical timing wheel, tasks are called on goroutine of wheel and must not block,
+// hand them over to workers, e.g. Channel.Schedule runs tasks on worker of channel.
+type TimerWheel struct {
+	tick    time.Duration
+	lock    sync.Mutex
+	current uint64 // ticks elapsed
+	levels  [wheelLevels][wheelSlots]*Timer
+	start   sync.Once
+	stop    chan struct{}
+}
+
+// NewTimerWheel create timer wheel with precision tick, it starts on first timer
+func NewTimerWheel(tick time.Duration) *TimerWheel {
+	if tick <= 0 {
+		tick = DefaultTimerTick
+	}
+	return &TimerWheel{tick: tick, stop: make(chan struct{})}
+}
+
+var defaultTimerWheel = NewTimerWheel(DefaultTimerTick)
+
+// AfterFunc call task once after delay
+func (w *TimerWheel) AfterFunc(delay time.Duration, task func()) *Timer {
+	return w.schedule(&Timer{task: task}, delay)
+}
+
+// Every call task after delay, then every period at fixed rate
+func (w *TimerWheel) Every(delay, period time.Duration, task func()) *Timer {
+	return w.schedule(&Timer{task: task, period: uint64(max(period/w.tick, 1))}, delay)
+}
+
+// Cron call task at times of cron schedule
+func (w *TimerWheel) Cron(cron *CronSchedule, task func()) *Timer {
+	return w.scheduleCron(&Timer{task: task, cron: cron})
+}
+
+// Stop wheel, timers not fired are dropped
+func (w *TimerWheel) Stop() {
+	w.start.Do(func() {}) // never start after stopped
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+}
+
+func (w *TimerWheel) schedule(t *Timer, delay time.Duration) *Timer {
+	w.start.Do(func() { go w.run() })
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// round up, timer never fires earlier than delay
+	t.expire = w.current + uint64((max(delay, 0)+w.tick-1)/w.tick)
+	w.add(t)
+	return t
+}
+
+// add timer to slot by ticks until it expires, must hold lock
+func (w *TimerWheel) add(t *Timer) {
+	expire := t.expire
+	if expire < w.current {
+		expire = w.current
+	}
+	delta, level := expire-w.current, 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	if delta >= 1<<(wheelBits*wheelLevels) {
+		// beyond the wheel, park at the farthest slot, added again on cascading
+		expire = w.current + 1<<(wheelBits*wheelLevels) - 1
+	}
+	idx := (expire >> (wheelBits * level)) & wheelMask
+	t.next, w.levels[level][idx] = w.levels[level][idx], t
+}
+
+func (w *TimerWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.advance()
+		}
+	}
+}
+
+// advance wheel by one tick, fire expired timers
+func (w *TimerWheel) advance() {
+	w.lock.Lock()
+	idx := w.current & wheelMask
+	// move timers of upper levels down once the lower level wrapped
+	for level := 1; idx == 0 && level < wheelLevels; level++ {
+		idx = (w.current >> (wheelBits * level)) & wheelMask
+		t := w.levels[level][idx]
+		w.levels[level][idx] = nil
+		for t != nil {
+			next := t.next
+			w.add(t)
+			t = next
+		}
+	}
+	idx = w.current & wheelMask
+	expired := w.levels[0][idx]
+	w.levels[0][idx] = nil
+	w.current++
+	w.lock.Unlock()
+	for t := expired; t != nil; {
+		next := t.next
+		t.next = nil
+		w.fire(t)
+		t = next
+	}
+}
+
+func (w *TimerWheel) fire(t *Timer) {
+	if t.Canceled() {
+		return
+	}
+	if t.period == 0 && t.cron == nil && !t.Cancel() {
+		return
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				logk.Error("timer task panic", zap.Any("recover", p))
+			}
+		}()
+		t.task()
+	}()
+	if t.Canceled() {
+		return
+	}
+	if t.period > 0 {
+		w.lock.Lock()
+		t.expire += t.period
+		w.add(t)
+		w.lock.Unlock()
+	} else if t.cron != nil {
+		w.scheduleCron(t)
+	}
+}
+
+// scheduleCron schedule timer at next time of its cron, canceled if none
+func (w *TimerWheel) scheduleCron(t *Timer) *Timer {
+	now := time.Now()
+	next := t.cron.Next(now)
+	if next.IsZero() {
+		t.Cancel()
+		return t
+	}
+	return w.schedule(t, next.Sub(now))
+}
@@ -0,0 +1,73 @@
+package smart
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond)
+	w.start.Do(func() {}) // advance by hand
+	var fired []int
+	w.AfterFunc(3*time.Millisecond, func() { fired = append(fired, 3) })
+	w.AfterFunc(100*time.Millisecond, func() { fired = append(fired, 100) })   // level 1
+	w.AfterFunc(5000*time.Millisecond, func() { fired = append(fired, 5000) }) // level 2
+	w.AfterFunc(10*time.Millisecond, func() { fired = append(fired, 10) }).Cancel()
+	every := w.Every(0, 40*time.Millisecond, func() { fired = append(fired, -1) })
+	for i := 0; i < 100; i++ {
+		w.advance()
+	}
+	assert.Equal(t, []int{-1, 3, -1, -1}, fired)
+	w.advance()
+	assert.Equal(t, []int{-1, 3, -1, -1, 100}, fired)
+	assert.True(t, every.Cancel())
+	for i := 0; i < 5000; i++ {
+		w.advance()
+	}
+	assert.Equal(t, []int{-1, 3, -1, -1, 100, 5000}, fired)
+}
+
+func TestCron(t *testing.T) {
+	daily, err := ParseCronIn("0 5 * * *", time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 10, 20, 5, 0, 0, 0, time.UTC), daily.Next(time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC), daily.Next(time.Date(2026, 10, 19, 4, 59, 30, 0, time.UTC)))
+	work, err := ParseCronIn("*/15 9-17 * * 1-5", time.UTC)
+	assert.Nil(t, err)
+	// friday 17:50 -> monday 09:00
+	assert.Equal(t, time.Date(2026, 10, 26, 9, 0, 0, 0, time.UTC), work.Next(time.Date(2026, 10, 23, 17, 50, 0, 0, time.UTC)))
+	// day of month or day of week
+	either, err := ParseCronIn("0 0 1 * 0", time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC), either.Next(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)))
+	hourly, err := ParseCronIn("@hourly", time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), hourly.Next(time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)))
+	never, err := ParseCronIn("0 0 31 2 *", time.UTC)
+	assert.Nil(t, err)
+	assert.True(t, never.Next(time.Now()).IsZero())
+	for _, spec := range []string{"0 5 * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err = ParseCron(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestChannelSchedule(t *testing.T) {
+	wm := NewWorkerManager(1, RoundRobin)
+	dc := &defaultChannel{ctx: context.Background(), worker: wm.Pick(0), workers: wm}
+	var once, rate int32
+	dc.Schedule(5*time.Millisecond, func() { atomic.AddInt32(&once, 1) })
+	dc.ScheduleAtFixedRate(0, 10*time.Millisecond, func() { atomic.AddInt32(&rate, 1) })
+	dc.Schedule(time.Hour, func() { t.Error("run after close") })
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&rate) >= 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&once))
+	dc.onClose()
+	n := atomic.LoadInt32(&rate)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&rate))
+	// scheduled after close is canceled
+	assert.True(t, dc.Schedule(0, func() { t.Error("run after close") }).Canceled())
+}
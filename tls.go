@@ -0,0 +1,255 @@
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"gitee.com/ywengineer/smart/pkg"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tlsHandshakeTimeout channel is closed if tls handshake not finished in time
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig files of tls, make it part of config of application and build tls.Config by ServerConfig or ClientConfig
+type TLSConfig struct {
+	CertFile string `json:"certFile" yaml:"certFile"` // certificate, required by server and by client of mutual tls
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+	// CAFile verifies peers, certificates of clients on server with MutualTLS, certificate of server on client.
+	// client uses system roots if empty
+	CAFile     string `json:"caFile" yaml:"caFile"`
+	MutualTLS  bool   `json:"mutualTLS" yaml:"mutualTLS"`   // server requires certificates of clients
+	ServerName string `json:"serverName" yaml:"serverName"` // client verifies certificate of server by name
+	// ReloadInterval files are checked every interval and reloaded once changed, 0 disables reloading
+	ReloadInterval time.Duration `json:"reloadInterval" yaml:"reloadInterval"`
+}
+
+// ServerConfig tls config of server, files are reloaded until ctx done. see Server.SetTLS
+func (c TLSConfig) ServerConfig(ctx context.Context) (*tls.Config, error) {
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		return nil, errors.New("certificate and key of tls server are required")
+	}
+	if c.MutualTLS && len(c.CAFile) == 0 {
+		return nil, errors.New("ca of mutual tls is required")
+	}
+	store, err := newCertStore(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return store.cert.Load(), nil
+		},
+	}
+	if c.MutualTLS {
+		conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cc := conf.Clone()
+			cc.GetConfigForClient, cc.ClientAuth, cc.ClientCAs = nil, tls.RequireAndVerifyClientCert, store.pool.Load()
+			return cc, nil
+		}
+	}
+	return conf, nil
+}
+
+// ClientConfig tls config of client, files are reloaded until ctx done. see DialSmartClientTLS
+func (c TLSConfig) ClientConfig(ctx context.Context) (*tls.Config, error) {
+	store, err := newCertStore(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.ServerName}
+	if store.cert.Load() != nil {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return store.cert.Load(), nil
+		}
+	}
+	if store.pool.Load() != nil {
+		// verify by ca reloaded instead of RootCAs fixed
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate of server")
+			}
+			opts := x509.VerifyOptions{DNSName: cs.ServerName, Roots: store.pool.Load(), Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return conf, nil
+}
+
+// certStore certificate and ca loaded from files
+type certStore struct {
+	conf  TLSConfig
+	cert  atomic.Pointer[tls.Certificate]
+	pool  atomic.Pointer[x509.CertPool]
+	stamp string // modify time of files
+}
+
+func newCertStore(ctx context.Context, conf TLSConfig) (*certStore, error) {
+	s := &certStore{conf: conf}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if conf.ReloadInterval > 0 {
+		go s.watch(ctx)
+	}
+	return s, nil
+}
+
+// load certificate and ca, none of them is replaced unless both loaded
+func (s *certStore) load() error {
+	stamp := s.modified()
+	var cert *tls.Certificate
+	var pool *x509.CertPool
+	if len(s.conf.CertFile) > 0 {
+		kp, err := tls.LoadX509KeyPair(s.conf.CertFile, s.conf.KeyFile)
+		if err != nil {
+			return errors.WithMessage(err, "load certificate of tls")
+		}
+		cert = &kp
+	}
+	if len(s.conf.CAFile) > 0 {
+		data, err := os.ReadFile(s.conf.CAFile)
+		if err != nil {
+			return errors.WithMessage(err, "load ca of tls")
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificate found in ca file [%s]", s.conf.CAFile)
+		}
+	}
+	if cert != nil {
+		s.cert.Store(cert)
+	}
+	if pool != nil {
+		s.pool.Store(pool)
+	}
+	s.stamp = stamp
+	return nil
+}
+
+// modified modify time of files
+func (s *certStore) modified() string {
+	var stamp string
+	for _, file := range []string{s.conf.CertFile, s.conf.KeyFile, s.conf.CAFile} {
+		if fi, err := os.Stat(file); err == nil {
+			stamp += fi.ModTime().String() + ";"
+		}
+	}
+	return stamp
+}
+
+// watch reload files once changed, the ones loaded before are kept if failed
+func (s *certStore) watch(ctx context.Context) {
+	tick := time.NewTicker(s.conf.ReloadInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			stamp := s.modified()
+			if stamp == s.stamp {
+				continue
+			}
+			if err := s.load(); err != nil {
+				s.stamp = stamp // retry once changed again
+				logk.Error("reload tls files error", zap.String("cert", s.conf.CertFile), zap.Error(err))
+			} else {
+				logk.Info("tls files reloaded", zap.String("cert", s.conf.CertFile))
+			}
+		}
+	}
+}
+
+// verifiedPeer channel over tls whose peer certificate is verified, e.g. client of mutual tls
+func verifiedPeer(channel Channel) bool {
+	if dc, ok := channel.(*defaultChannel); ok {
+		if c, ok := dc.conn.(*pkg.TLSConn); ok {
+			return len(c.ConnectionState().VerifiedChains) > 0
+		}
+	}
+	return false
+}
+
+// serveTLS accept channels of listener over tls until listener closed, tune set socket options of tcp conn if not nil
+func (s *baseServer) serveTLS(l listener, tune func(c *net.TCPConn)) error {
+	ln, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return errors.WithMessagef(err, "create tls listener %s", l)
+	}
+	s.tlsLock.Lock()
+	s.tlsListeners = append(s.tlsListeners, ln)
+	s.tlsLock.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.loadStatus() > running {
+				return nil
+			}
+			return errors.WithMessagef(err, "accept tls listener %s", l)
+		}
+		if tc, ok := conn.(*net.TCPConn); ok && tune != nil {
+			tune(tc)
+		}
+		go s.serveTLSConn(tls.Server(conn, l.tls), l.initializers)
+	}
+}
+
+// serveTLSConn read channel over tls on its own goroutine
+func (s *baseServer) serveTLSConn(conn *tls.Conn, initializers []ChannelInitializer) {
+	ctx, cancel := context.WithTimeout(s.ctx, tlsHandshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		logk.Debug("tls handshake error", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	c := pkg.NetTLSConn(conn)
+	s.tlsConns.Store(c, struct{}{})
+	defer s.tlsConns.Delete(c)
+	channel := s.onChannelOpen(c, initializers)
+	if channel == nil {
+		return
+	}
+	for c.Fill() == nil {
+		if errors.Is(s.onChannelRead(c.Fd()), ErrNotRegisteredChannel) {
+			break
+		}
+	}
+	_ = c.Close()
+	// fd may be taken by other channel once closed
+	s.channels.CompareAndDelete(c.Fd(), channel)
+	atomic.AddInt32(&s.channelCount, -1)
+	channel.onClose()
+}
+
+// closeTLS close tls listeners and channels
+func (s *baseServer) closeTLS() error {
+	s.tlsLock.Lock()
+	defer s.tlsLock.Unlock()
+	var err error
+	for _, ln := range s.tlsListeners {
+		if e := ln.Close(); e != nil {
+			err = e
+		}
+	}
+	s.tlsListeners = nil
+	s.tlsConns.Range(func(key, value interface{}) bool {
+		_ = key.(*pkg.TLSConn).Close()
+		return true
+	})
+	return err
+}
@@ -0,0 +1,141 @@
+package smart
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gitee.com/ywengineer/smart/pkg"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert write certificate signed by parent (self signed if nil) and its key into dir, returns paths of them
+func writeCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile, cert, key
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _, ca, caKey := writeCert(t, dir, "ca", 1, nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "server", 2, ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "client", 3, ca, caKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverConf, err := TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile, MutualTLS: true}.ServerConfig(ctx)
+	assert.Nil(t, err)
+	_, err = TLSConfig{CertFile: serverCert, KeyFile: serverKey, MutualTLS: true}.ServerConfig(ctx)
+	assert.Error(t, err)
+	//
+	srv := &defaultServer{baseServer: newTestBase(t, func(channel Channel) {})}
+	srv.holder = srv
+	addr := freeAddr(t)
+	assert.Nil(t, srv.ListenTLS("tcp", addr, serverConf, func(channel Channel) { channel.SetAttachment("tls") }))
+	spinTest(srv.baseServer)
+	tlsChannels := func() int {
+		n := 0
+		srv.channels.Range(func(key, value interface{}) bool {
+			if value.(Channel).GetAttachment() == "tls" {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+	// client with certificate signed by ca
+	clientConf, err := TLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile, ServerName: "localhost"}.ClientConfig(ctx)
+	assert.Nil(t, err)
+	var c Channel
+	assert.Eventually(t, func() bool {
+		c, err = DialSmartClientTLS(ctx, "tcp", addr, clientConf, []ChannelInitializer{func(channel Channel) {}}, false)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return tlsChannels() == 1 }, time.Second, 10*time.Millisecond)
+	// client without certificate is refused
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: clientConf.RootCAs, InsecureSkipVerify: true})
+	if err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	assert.Error(t, err)
+	assert.Equal(t, 1, tlsChannels())
+	//
+	_ = c.Close()
+	assert.Eventually(t, func() bool { return tlsChannels() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, srv.Shutdown(context.Background()))
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	_, _, ca, caKey := writeCert(t, dir, "ca", 1, nil, nil)
+	certFile, keyFile, _, _ := writeCert(t, dir, "server", 2, ca, caKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caFile := filepath.Join(dir, "ca.crt")
+	store, err := newCertStore(ctx, TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, ReloadInterval: 10 * time.Millisecond})
+	assert.Nil(t, err)
+	serial := func() int64 {
+		leaf, err := x509.ParseCertificate(store.cert.Load().Certificate[0])
+		assert.Nil(t, err)
+		return leaf.SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+	// broken files keep certificate loaded before
+	assert.Nil(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	assert.Nil(t, os.Chtimes(certFile, time.Now(), time.Now().Add(time.Minute)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(2), serial())
+	// certificate is not replaced if ca failed
+	writeCert(t, dir, "server", 3, ca, caKey)
+	caData, err := os.ReadFile(caFile)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(caFile, []byte("broken"), 0600))
+	assert.Nil(t, os.Chtimes(certFile, time.Now(), time.Now().Add(2*time.Minute)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(2), serial())
+	writeCert(t, dir, "server", 4, ca, caKey)
+	assert.Nil(t, os.WriteFile(caFile, caData, 0600))
+	assert.Nil(t, os.Chtimes(certFile, time.Now(), time.Now().Add(3*time.Minute)))
+	assert.Eventually(t, func() bool { return serial() == 4 }, time.Second, 10*time.Millisecond)
+	// conn without fd has unique id
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	id1, id2 := pkg.NetTLSConn(tls.Client(c1, &tls.Config{})).Fd(), pkg.NetTLSConn(tls.Client(c2, &tls.Config{})).Fd()
+	assert.Less(t, id1, 0)
+	assert.NotEqual(t, id1, id2)
+}
@@ -0,0 +1,166 @@
+package smart
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ValidateTag struct tag of request field, rules split by comma. e.g. `validate:"required,min=1,max=99,maxlen=16"`
+//
+//	required: field must not be zero value
+//	min, max: range of numeric field
+//	minlen, maxlen: length range of string, slice or map field
+const ValidateTag = "validate"
+
+// Validator request implements Validator will be validated before handler invoked
+type Validator interface {
+	Validate() error
+}
+
+var typeValidator = reflect.TypeOf((*Validator)(nil)).Elem()
+
+type fieldRule struct {
+	index    int
+	name     string
+	required bool
+	min, max *float64
+	minLen   int
+	maxLen   int // < 0 means no limit
+}
+
+// requestValidator compiled validation rules of a request type
+type requestValidator struct {
+	self  bool // implements Validator
+	rules []*fieldRule
+}
+
+// newRequestValidator compile rules of request type, returns nil if nothing to validate
+func newRequestValidator(inType reflect.Type) (*requestValidator, error) {
+	rv := &requestValidator{self: inType.Implements(typeValidator)}
+	st := inType
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() == reflect.Struct {
+		for i := 0; i < st.NumField(); i++ {
+			f := st.Field(i)
+			tag, ok := f.Tag.Lookup(ValidateTag)
+			if !ok || !f.IsExported() || tag == "" || tag == "-" {
+				continue
+			}
+			rule, err := parseFieldRule(i, f, tag)
+			if err != nil {
+				return nil, errors.WithMessage(err, fmt.Sprintf("invalid validate tag of %s.%s", st.Name(), f.Name))
+			}
+			rv.rules = append(rv.rules, rule)
+		}
+	}
+	if !rv.self && len(rv.rules) == 0 {
+		return nil, nil
+	}
+	return rv, nil
+}
+
+func parseFieldRule(index int, f reflect.StructField, tag string) (*fieldRule, error) {
+	rule := &fieldRule{index: index, name: f.Name, maxLen: -1}
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		rule.name = name
+	}
+	for _, r := range strings.Split(tag, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(r), "=")
+		switch k {
+		case "required":
+			rule.required = true
+		case "min", "max":
+			if !isNumericKind(f.Type.Kind()) {
+				return nil, fmt.Errorf("%s only supports numeric field", k)
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			if k == "min" {
+				rule.min = &n
+			} else {
+				rule.max = &n
+			}
+		case "minlen", "maxlen":
+			if kd := f.Type.Kind(); kd != reflect.String && kd != reflect.Slice && kd != reflect.Map && kd != reflect.Array {
+				return nil, fmt.Errorf("%s only supports string, slice or map field", k)
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, err
+			}
+			if k == "minlen" {
+				rule.minLen = n
+			} else {
+				rule.maxLen = n
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown validate rule: %s", k)
+		}
+	}
+	return rule, nil
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	return (k >= reflect.Int && k <= reflect.Uint64) || k == reflect.Float32 || k == reflect.Float64
+}
+
+// validate returns *Error with ErrCodeInvalidRequest when in is invalid
+func (rv *requestValidator) validate(in interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(in))
+	for _, rule := range rv.rules {
+		if err := rule.check(v.Field(rule.index)); err != nil {
+			return NewErrorf(ErrCodeInvalidRequest, "%s %s", rule.name, err.Error())
+		}
+	}
+	if rv.self {
+		if err := in.(Validator).Validate(); err != nil {
+			var se *Error
+			if errors.As(err, &se) {
+				return se
+			}
+			return NewError(ErrCodeInvalidRequest, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *fieldRule) check(fv reflect.Value) error {
+	if r.required && fv.IsZero() {
+		return errors.New("is required")
+	}
+	if r.min != nil || r.max != nil {
+		var n float64
+		switch {
+		case fv.CanInt():
+			n = float64(fv.Int())
+		case fv.CanUint():
+			n = float64(fv.Uint())
+		default:
+			n = fv.Float()
+		}
+		if r.min != nil && n < *r.min {
+			return fmt.Errorf("must be >= %v", *r.min)
+		}
+		if r.max != nil && n > *r.max {
+			return fmt.Errorf("must be <= %v", *r.max)
+		}
+	}
+	if r.minLen > 0 || r.maxLen >= 0 {
+		l := fv.Len()
+		if l < r.minLen {
+			return fmt.Errorf("length must be >= %d", r.minLen)
+		}
+		if r.maxLen >= 0 && l > r.maxLen {
+			return fmt.Errorf("length must be <= %d", r.maxLen)
+		}
+	}
+	return nil
+}
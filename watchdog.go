@@ -0,0 +1,141 @@
+package smart
+
+import (
+	"bytes"
+	"context"
+	"gitee.com/ywengineer/smart-kit/pkg/logk"
+	"go.uber.org/zap"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSlowHandlerThreshold invocation exceeds it is reported by watchdog of router
+const DefaultSlowHandlerThreshold = time.Second
+
+// invocation a running handler invocation watched by watchdog
+type invocation struct {
+	hd       *handlerDefinition
+	fd       int
+	seq      int32
+	start    time.Time
+	reported int32
+}
+
+// watchdog find handler invocations exceed threshold, log them with stack of the goroutine running them.
+// a blocked handler stalls its worker and all channels sharing the worker, the stack tells who did it.
+type watchdog struct {
+	threshold int64 // time.Duration, <= 0 disabled
+	seq       uint64
+	running   sync.Map // key=uint64, value=*invocation
+}
+
+func newWatchdog(threshold time.Duration) *watchdog {
+	return &watchdog{threshold: int64(threshold)}
+}
+
+func (w *watchdog) getThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.threshold))
+}
+
+func (w *watchdog) setThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&w.threshold, int64(threshold))
+}
+
+// begin watch an invocation, returns 0 when watchdog disabled
+func (w *watchdog) begin(hd *handlerDefinition, fd int, seq int32) uint64 {
+	if w.getThreshold() <= 0 {
+		return 0
+	}
+	id := atomic.AddUint64(&w.seq, 1)
+	w.running.Store(id, &invocation{hd: hd, fd: fd, seq: seq, start: time.Now()})
+	return id
+}
+
+func (w *watchdog) end(id uint64) {
+	if id == 0 {
+		return
+	}
+	if v, ok := w.running.LoadAndDelete(id); ok {
+		inv := v.(*invocation)
+		// finished between two checks, stack is gone
+		if cost := time.Since(inv.start); cost > w.getThreshold() && atomic.LoadInt32(&inv.reported) == 0 {
+			logk.Warn("slow handler finished", inv.fields(cost)...)
+		}
+	}
+}
+
+// run check running invocations until ctx done
+func (w *watchdog) run(ctx context.Context) {
+	interval := func() time.Duration {
+		if d := w.getThreshold() / 2; d > 10*time.Millisecond {
+			return d
+		}
+		return 10 * time.Millisecond
+	}
+	timer := time.NewTimer(interval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			w.check()
+			timer.Reset(interval())
+		}
+	}
+}
+
+func (w *watchdog) check() {
+	threshold := w.getThreshold()
+	if threshold <= 0 {
+		return
+	}
+	var stacks [][]byte
+	w.running.Range(func(key, value interface{}) bool {
+		inv := value.(*invocation)
+		if cost := time.Since(inv.start); cost > threshold && atomic.CompareAndSwapInt32(&inv.reported, 0, 1) {
+			if stacks == nil {
+				stacks = goroutineStacks()
+			}
+			logk.Error("slow handler is running", append(inv.fields(cost), zap.ByteStrings("stack", handlerStacks(stacks, inv.hd.name)))...)
+		}
+		return true
+	})
+}
+
+func (inv *invocation) fields(cost time.Duration) []zap.Field {
+	return []zap.Field{
+		zap.String("module", inv.hd.module),
+		zap.String("handler", inv.hd.name),
+		zap.Int("route", inv.hd.messageCode),
+		zap.Int("channel", inv.fd),
+		zap.Int32("seq", inv.seq),
+		zap.Duration("cost", cost),
+	}
+}
+
+// goroutineStacks returns stacks of all goroutines
+func goroutineStacks() [][]byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return bytes.Split(buf[:n], []byte("\n\n"))
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// handlerStacks stacks of goroutines running handler method
+func handlerStacks(stacks [][]byte, method string) [][]byte {
+	var matched [][]byte
+	frame := []byte(")." + method + "(")
+	for _, stack := range stacks {
+		if bytes.Contains(stack, frame) {
+			matched = append(matched, stack)
+		}
+	}
+	return matched
+}
@@ -4,6 +4,9 @@ import (
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"github.com/bytedance/gopkg/lang/fastrand"
 	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -16,48 +19,131 @@ const (
 	// Hash requests that connections are bind to a fixed pool.
 	Hash
 	RoundRobin
+	// LeastPending requests that connections are bind to the pool with the least queued tasks.
+	LeastPending
+	// PowerOfTwo requests that connections are bind to the less loaded of two random pools.
+	PowerOfTwo
 )
 
-// loadBalance sets the load balancing method for []*Pool
-type loadBalance interface {
+// rebalanceGap pending tasks per weight a worker must exceed the chosen one before channels move off it
+const rebalanceGap = 4
+
+// Balancer sets the load balancing method for workers, plug custom one by RegisterLoadBalance
+type Balancer interface {
 	LoadBalance() LoadBalance
 	// Pick Choose the most qualified Pool
 	Pick(id int) Worker
 }
 
-func parseLoadBalance(lb string) LoadBalance {
-	switch lb {
+// Rebalancer optional hook of Balancer, called when channel has no queued task before running the next one.
+// return other worker to move channel to it, tasks of channel keep ordered since none is queued on current.
+type Rebalancer interface {
+	Rebalance(id int, current Worker) Worker
+}
+
+// BalancerFactory create balancer for workers, weights[i] is weight of workers[i] and at least 1
+type BalancerFactory func(workers []Worker, weights []int) Balancer
+
+var customBalancers = struct {
+	lock      sync.RWMutex
+	names     map[string]LoadBalance
+	factories map[LoadBalance]BalancerFactory
+}{names: map[string]LoadBalance{}, factories: map[LoadBalance]BalancerFactory{}}
+
+// RegisterLoadBalance register custom balancer, select it by name in WorkerLoadBalance of config
+func RegisterLoadBalance(name string, factory BalancerFactory) LoadBalance {
+	customBalancers.lock.Lock()
+	defer customBalancers.lock.Unlock()
+	lb, ok := customBalancers.names[name]
+	if !ok {
+		lb = PowerOfTwo + 1 + LoadBalance(len(customBalancers.names))
+		customBalancers.names[name] = lb
+	}
+	customBalancers.factories[lb] = factory
+	return lb
+}
+
+// parseLoadBalance parse "name" or "name:w1,w2,..." with weights of workers, e.g. "least:2,2,1,1"
+func parseLoadBalance(lb string) (LoadBalance, []int) {
+	name, ws, _ := strings.Cut(lb, ":")
+	var weights []int
+	if len(ws) > 0 {
+		for _, s := range strings.Split(ws, ",") {
+			w, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || w < 1 {
+				logk.Warn("invalid worker weight, default to 1", zap.String("lb", lb), zap.String("weight", s))
+				w = 1
+			}
+			weights = append(weights, w)
+		}
+	}
+	switch name {
 	case "random":
-		return Random
+		return Random, weights
 	case "hash":
-		return Hash
+		return Hash, weights
 	case "rr":
-		return RoundRobin
+		return RoundRobin, weights
+	case "least":
+		return LeastPending, weights
+	case "p2c":
+		return PowerOfTwo, weights
+	}
+	customBalancers.lock.RLock()
+	defer customBalancers.lock.RUnlock()
+	if custom, ok := customBalancers.names[name]; ok {
+		return custom, weights
 	}
 	logk.Warn("unknown load balance, default to RoundRobin", zap.String("lb", lb))
-	return RoundRobin
+	return RoundRobin, weights
 }
 
-func newLoadBalance(lb LoadBalance, pools []Worker) loadBalance {
+func newLoadBalance(lb LoadBalance, pools []Worker, weights []int) Balancer {
 	switch lb {
 	case Random:
-		return newRandomLB(pools)
+		return newRandomLB(pools, weights)
 	case Hash:
-		return newHashLB(pools)
+		return newHashLB(pools, weights)
 	case RoundRobin:
-		return newRoundRobinLB(pools)
+		return newRoundRobinLB(pools, weights)
+	case LeastPending:
+		return newLeastPendingLB(pools, weights)
+	case PowerOfTwo:
+		return newPowerOfTwoLB(pools, weights)
+	}
+	customBalancers.lock.RLock()
+	factory, ok := customBalancers.factories[lb]
+	customBalancers.lock.RUnlock()
+	if ok {
+		return factory(pools, weights)
+	}
+	return newRoundRobinLB(pools, weights)
+}
+
+// weightedSlots indexes of workers repeated by weight, interleaved so that consecutive slots spread over workers
+func weightedSlots(weights []int) []int {
+	var slots []int
+	for round := 0; ; round++ {
+		n := len(slots)
+		for idx, w := range weights {
+			if w > round {
+				slots = append(slots, idx)
+			}
+		}
+		if len(slots) == n {
+			return slots
+		}
 	}
-	return newRoundRobinLB(pools)
 }
 
 // randomLB
-func newRandomLB(pools []Worker) loadBalance {
-	return &randomLB{pools: pools, poolSize: len(pools)}
+func newRandomLB(pools []Worker, weights []int) Balancer {
+	return &randomLB{pools: pools, slots: weightedSlots(weights)}
 }
 
 type randomLB struct {
-	pools    []Worker
-	poolSize int
+	pools []Worker
+	slots []int
 }
 
 func (b *randomLB) LoadBalance() LoadBalance {
@@ -65,18 +151,18 @@ func (b *randomLB) LoadBalance() LoadBalance {
 }
 
 func (b *randomLB) Pick(id int) Worker {
-	idx := fastrand.Intn(b.poolSize)
-	return b.pools[idx]
+	idx := fastrand.Intn(len(b.slots))
+	return b.pools[b.slots[idx]]
 }
 
 // hashLB
-func newHashLB(pools []Worker) loadBalance {
-	return &hashLB{pools: pools, poolSize: len(pools)}
+func newHashLB(pools []Worker, weights []int) Balancer {
+	return &hashLB{pools: pools, slots: weightedSlots(weights)}
 }
 
 type hashLB struct {
-	pools    []Worker
-	poolSize int
+	pools []Worker
+	slots []int
 }
 
 func (b *hashLB) LoadBalance() LoadBalance {
@@ -84,26 +170,118 @@ func (b *hashLB) LoadBalance() LoadBalance {
 }
 
 func (b *hashLB) Pick(id int) Worker {
-	idx := id % b.poolSize
-	return b.pools[idx]
+	idx := id % len(b.slots)
+	return b.pools[b.slots[idx]]
 }
 
 // roundRobinLB
-func newRoundRobinLB(pools []Worker) loadBalance {
-	return &roundRobinLB{pools: pools, poolSize: len(pools)}
+func newRoundRobinLB(pools []Worker, weights []int) Balancer {
+	return &roundRobinLB{pools: pools, slots: weightedSlots(weights)}
 }
 
 type roundRobinLB struct {
 	pools    []Worker
+	slots    []int
 	accepted uintptr // accept counter
-	poolSize int
 }
 
 func (b *roundRobinLB) LoadBalance() LoadBalance {
-	return Hash
+	return RoundRobin
 }
 
 func (b *roundRobinLB) Pick(id int) Worker {
-	idx := int(atomic.AddUintptr(&b.accepted, 1)) % b.poolSize
-	return b.pools[idx]
+	idx := int(atomic.AddUintptr(&b.accepted, 1) % uintptr(len(b.slots)))
+	return b.pools[b.slots[idx]]
+}
+
+// loadedLB base of balancers by queue depth of workers
+type loadedLB struct {
+	pools   []Worker
+	weights []int
+	index   map[Worker]int
+}
+
+func newLoadedLB(pools []Worker, weights []int) loadedLB {
+	b := loadedLB{pools: pools, weights: weights, index: make(map[Worker]int, len(pools))}
+	for idx, w := range pools {
+		b.index[w] = idx
+	}
+	return b
+}
+
+// load pending tasks of worker per weight
+func (b *loadedLB) load(idx int) float64 {
+	return float64(b.pools[idx].Pending()) / float64(b.weights[idx])
+}
+
+func (b *loadedLB) rebalance(current, candidate Worker) Worker {
+	idx, ok := b.index[current]
+	if !ok || candidate == current {
+		return current
+	}
+	if b.load(idx)-b.load(b.index[candidate]) >= rebalanceGap {
+		return candidate
+	}
+	return current
+}
+
+// leastPendingLB
+func newLeastPendingLB(pools []Worker, weights []int) Balancer {
+	return &leastPendingLB{loadedLB: newLoadedLB(pools, weights)}
+}
+
+type leastPendingLB struct {
+	loadedLB
+	accepted uintptr // start of scan, spread ties over workers
+}
+
+func (b *leastPendingLB) LoadBalance() LoadBalance {
+	return LeastPending
+}
+
+func (b *leastPendingLB) Pick(id int) Worker {
+	n := len(b.pools)
+	start := int(atomic.AddUintptr(&b.accepted, 1) % uintptr(n))
+	best, bestLoad := start, b.load(start)
+	for i := 1; i < n && bestLoad > 0; i++ {
+		idx := (start + i) % n
+		if l := b.load(idx); l < bestLoad {
+			best, bestLoad = idx, l
+		}
+	}
+	return b.pools[best]
+}
+
+func (b *leastPendingLB) Rebalance(id int, current Worker) Worker {
+	return b.rebalance(current, b.Pick(id))
+}
+
+// powerOfTwoLB
+func newPowerOfTwoLB(pools []Worker, weights []int) Balancer {
+	return &powerOfTwoLB{loadedLB: newLoadedLB(pools, weights)}
+}
+
+type powerOfTwoLB struct {
+	loadedLB
+}
+
+func (b *powerOfTwoLB) LoadBalance() LoadBalance {
+	return PowerOfTwo
+}
+
+func (b *powerOfTwoLB) Pick(id int) Worker {
+	n := len(b.pools)
+	if n == 1 {
+		return b.pools[0]
+	}
+	i := fastrand.Intn(n)
+	j := (i + 1 + fastrand.Intn(n-1)) % n
+	if b.load(j) < b.load(i) {
+		i = j
+	}
+	return b.pools[i]
+}
+
+func (b *powerOfTwoLB) Rebalance(id int, current Worker) Worker {
+	return b.rebalance(current, b.Pick(id))
 }
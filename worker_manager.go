@@ -5,18 +5,58 @@ import (
 	"fmt"
 	"gitee.com/ywengineer/smart-kit/pkg/logk"
 	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWorkerQueueFull task rejected since queue of worker reached its limit
+var ErrWorkerQueueFull = errors.New("worker queue is full")
+
+// OverflowPolicy handles message of channel arrived when queue of its worker is full
+type OverflowPolicy int
+
+const (
+	// OverflowReject reply error ErrCodeServiceUnavailable to the message
+	OverflowReject OverflowPolicy = iota
+	// OverflowDrop drop the message silently
+	OverflowDrop
+	// OverflowClose close the channel flooding the worker
+	OverflowClose
 )
 
 type WorkerManager interface {
 	Pick(id int) Worker
+	// PickKey worker owns key by consistent hashing, see WithDispatchKey
+	PickKey(key string) Worker
+	// Rebalance worker idle channel should move to, current if not moved. see Rebalancer
+	Rebalance(id int, current Worker) Worker
 	RunningWorker() int
+	// Pending tasks queued or running on all workers
+	Pending() int
+	// SetQueueLimit bound pending tasks of each worker to limit, messages beyond it are handled by policy.
+	// limit <= 0 means unbounded, the default.
+	SetQueueLimit(limit int, policy OverflowPolicy)
+	// Overflow policy for messages rejected by full queue
+	Overflow() OverflowPolicy
+	// Metrics returns metrics of all workers
+	Metrics() []WorkerMetrics
+	// Resize grow or shrink workers at runtime, channels on removed workers move after their queued tasks finished
+	Resize(poolSize int, lb LoadBalance, weights ...int)
 }
 
 type Worker interface {
 	Run(ctx context.Context, f func())
+	// TryRun run f unless queue of worker is full, returns ErrWorkerQueueFull then
+	TryRun(ctx context.Context, f func()) error
 	Running() bool
+	// Pending tasks queued or running on worker
+	Pending() int
 }
 
 func NewSingleWorker(name string, panicHandler func(context.Context, interface{})) Worker {
@@ -25,38 +65,151 @@ func NewSingleWorker(name string, panicHandler func(context.Context, interface{}
 	return &defaultWorker{runner: p}
 }
 
-// NewWorkerManager create default worker manager for process client channel
-func NewWorkerManager(poolSize int, lb LoadBalance) WorkerManager {
+// NewWorkerManager create default worker manager for process client channel.
+// weights[i] is weight of the i-th worker, missing or invalid weight is 1.
+func NewWorkerManager(poolSize int, lb LoadBalance, weights ...int) WorkerManager {
+	manager := &defaultWorkerManager{}
+	manager.Resize(poolSize, lb, weights...)
+	return manager
+}
+
+type defaultWorkerManager struct {
+	lock     sync.Mutex // serialize Resize and SetQueueLimit
+	pool     atomic.Pointer[workerPool]
+	retired  []*defaultWorker // workers removed by Resize with pending tasks
+	limit    int64            // queue limit of workers
+	overflow int32            // OverflowPolicy
+}
+
+// workerPool workers and balancer of them, replaced as a whole by Resize
+type workerPool struct {
+	balance    Balancer       // load balancing method
+	rebalancer Rebalancer     // nil if balance does not move channels
+	workers    []Worker       // all the workers
+	index      map[Worker]int // index of workers
+	ring       *hashRing      // index of workers for keys
+}
+
+// Resize grow or shrink workers to poolSize and balance them by lb, e.g. on config change.
+// the first workers are kept, new workers are appended and the last ones are retired on shrinking.
+// tasks queued on retired workers still run there, channels move off them before their next message.
+// keys of WithDispatchKey owned by other workers after resizing may overlap tasks queued before for a moment.
+func (m *defaultWorkerManager) Resize(poolSize int, lb LoadBalance, weights ...int) {
 	if poolSize < 1 {
 		poolSize = runtime.NumCPU() * 2
 		logk.Warnf("invalid poolSize, will set core * 2 = %d", poolSize)
 	}
-	logk.Infof("create worker manager with pool size [%d]", poolSize)
-	manager := &defaultWorkerManager{}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var workers []Worker
+	if old := m.pool.Load(); old != nil {
+		workers = old.workers
+		for _, w := range workers[min(poolSize, len(workers)):] {
+			m.retired = append(m.retired, w.(*defaultWorker))
+		}
+		logk.Info("resize worker manager", zap.Int("from", len(workers)), zap.Int("to", poolSize), zap.Int("lb", int(lb)))
+	} else {
+		logk.Infof("create worker manager with pool size [%d]", poolSize)
+	}
+	m.pruneRetired()
+	pool := &workerPool{index: make(map[Worker]int, poolSize), ring: newHashRing()}
+	pool.workers = append(pool.workers, workers[:min(poolSize, len(workers))]...)
+	ws := make([]int, poolSize)
 	for idx := 0; idx < poolSize; idx++ {
-		manager.workers = append(manager.workers, NewSingleWorker(fmt.Sprintf("smart-worker-%d", idx), manager.errorHandler))
+		if idx >= len(pool.workers) {
+			w := NewSingleWorker(fmt.Sprintf("smart-worker-%d", idx), m.errorHandler)
+			w.(*defaultWorker).limit = m.limit
+			pool.workers = append(pool.workers, w)
+		}
+		pool.index[pool.workers[idx]] = idx
+		pool.ring.add(strconv.Itoa(idx), 1)
+		ws[idx] = 1
+		if idx < len(weights) && weights[idx] > 0 {
+			ws[idx] = weights[idx]
+		}
 	}
-	manager.balance = newLoadBalance(lb, manager.workers)
-	return manager
+	pool.balance = newLoadBalance(lb, pool.workers, ws)
+	pool.rebalancer, _ = pool.balance.(Rebalancer)
+	m.pool.Store(pool)
 }
 
-type defaultWorkerManager struct {
-	balance loadBalance // load balancing method
-	workers []Worker    // all the workers
+// pruneRetired forget retired workers without pending tasks, must hold lock
+func (m *defaultWorkerManager) pruneRetired() {
+	retired := m.retired[:0]
+	for _, w := range m.retired {
+		if w.Pending() > 0 {
+			retired = append(retired, w)
+		}
+	}
+	m.retired = retired
 }
 
 // Pick will select the poller for use each time based on the LoadBalance.
 func (m *defaultWorkerManager) Pick(id int) Worker {
-	return m.balance.Pick(id)
+	return m.pool.Load().balance.Pick(id)
+}
+
+func (m *defaultWorkerManager) PickKey(key string) Worker {
+	pool := m.pool.Load()
+	idx, _ := strconv.Atoi(pool.ring.get(key))
+	return pool.workers[idx]
+}
+
+// Rebalance move channels off workers retired by Resize, otherwise ask Rebalancer of balancer
+func (m *defaultWorkerManager) Rebalance(id int, current Worker) Worker {
+	pool := m.pool.Load()
+	if _, ok := pool.index[current]; !ok {
+		return pool.balance.Pick(id)
+	}
+	if pool.rebalancer == nil {
+		return current
+	}
+	return pool.rebalancer.Rebalance(id, current)
+}
+
+func (m *defaultWorkerManager) Pending() int {
+	n := 0
+	for _, worker := range m.pool.Load().workers {
+		n += worker.Pending()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, worker := range m.retired {
+		n += worker.Pending()
+	}
+	return n
+}
+
+func (m *defaultWorkerManager) SetQueueLimit(limit int, policy OverflowPolicy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limit = int64(limit)
+	atomic.StoreInt32(&m.overflow, int32(policy))
+	for _, w := range m.pool.Load().workers {
+		atomic.StoreInt64(&w.(*defaultWorker).limit, int64(limit))
+	}
+}
+
+func (m *defaultWorkerManager) Overflow() OverflowPolicy {
+	return OverflowPolicy(atomic.LoadInt32(&m.overflow))
+}
+
+func (m *defaultWorkerManager) Metrics() []WorkerMetrics {
+	workers := m.pool.Load().workers
+	ms := make([]WorkerMetrics, 0, len(workers))
+	for _, w := range workers {
+		ms = append(ms, w.(*defaultWorker).metrics())
+	}
+	return ms
 }
 
 func (m *defaultWorkerManager) errorHandler(ctx context.Context, err interface{}) {
-	logk.Error("process worker task error", zap.Any("error", err))
+	logk.Error("process worker task error", zap.Any("error", err), zap.ByteString("stack", debug.Stack()))
 }
 
 func (m *defaultWorkerManager) RunningWorker() int {
 	n := 0
-	for _, worker := range m.workers {
+	for _, worker := range m.pool.Load().workers {
 		if worker.Running() {
 			n += 1
 		}
@@ -65,11 +218,47 @@ func (m *defaultWorkerManager) RunningWorker() int {
 }
 
 type defaultWorker struct {
-	runner gopool.Pool
+	runner   gopool.Pool
+	pending  int64
+	limit    int64 // max pending tasks accepted by TryRun, <= 0 means unbounded
+	executed int64
+	rejected int64
+	wait     latencyMetrics
+	exec     latencyMetrics
 }
 
 func (w *defaultWorker) Run(ctx context.Context, f func()) {
-	w.runner.CtxGo(ctx, f)
+	atomic.AddInt64(&w.pending, 1)
+	w.run(ctx, f)
+}
+
+func (w *defaultWorker) TryRun(ctx context.Context, f func()) error {
+	limit := atomic.LoadInt64(&w.limit)
+	if n := atomic.AddInt64(&w.pending, 1); limit > 0 && n > limit {
+		atomic.AddInt64(&w.pending, -1)
+		atomic.AddInt64(&w.rejected, 1)
+		return ErrWorkerQueueFull
+	}
+	w.run(ctx, f)
+	return nil
+}
+
+func (w *defaultWorker) run(ctx context.Context, f func()) {
+	queued := time.Now()
+	w.runner.CtxGo(ctx, func() {
+		ts := time.Now()
+		w.wait.observe(ts.Sub(queued))
+		defer func() {
+			w.exec.observe(time.Since(ts))
+			atomic.AddInt64(&w.executed, 1)
+			atomic.AddInt64(&w.pending, -1)
+		}()
+		f()
+	})
+}
+
+func (w *defaultWorker) Pending() int {
+	return int(atomic.LoadInt64(&w.pending))
 }
 
 func (w *defaultWorker) Name() string {
@@ -79,3 +268,14 @@ func (w *defaultWorker) Name() string {
 func (w *defaultWorker) Running() bool {
 	return w.runner.WorkerCount() > 0
 }
+
+func (w *defaultWorker) metrics() WorkerMetrics {
+	return WorkerMetrics{
+		Name:     w.Name(),
+		Pending:  w.Pending(),
+		Executed: atomic.LoadInt64(&w.executed),
+		Rejected: atomic.LoadInt64(&w.rejected),
+		Wait:     w.wait.latency(),
+		Exec:     w.exec.latency(),
+	}
+}
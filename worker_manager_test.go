@@ -0,0 +1,147 @@
+package smart
+
+import (
+	"context"
+	"gitee.com/ywengineer/smart/message"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadBalance(t *testing.T) {
+	lb, weights := parseLoadBalance("least:2,1")
+	assert.Equal(t, LeastPending, lb)
+	assert.Equal(t, []int{2, 1}, weights)
+	// weighted round-robin
+	wm := NewWorkerManager(2, RoundRobin, 2, 1).(*defaultWorkerManager)
+	assert.Equal(t, RoundRobin, wm.pool.Load().balance.LoadBalance())
+	picked := map[Worker]int{}
+	for i := 0; i < 30; i++ {
+		picked[wm.Pick(i)]++
+	}
+	assert.Equal(t, 20, picked[wm.pool.Load().workers[0]])
+	// block worker 0 with queued tasks
+	for _, lb := range []LoadBalance{LeastPending, PowerOfTwo} {
+		wm = NewWorkerManager(2, lb).(*defaultWorkerManager)
+		release := make(chan struct{})
+		for i := 0; i < rebalanceGap+1; i++ {
+			wm.pool.Load().workers[0].Run(context.Background(), func() { <-release })
+		}
+		assert.Equal(t, rebalanceGap+1, wm.pool.Load().workers[0].Pending())
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, wm.pool.Load().workers[1], wm.Pick(i))
+		}
+		assert.Equal(t, wm.pool.Load().workers[1], wm.Rebalance(0, wm.pool.Load().workers[0]))
+		assert.Equal(t, wm.pool.Load().workers[1], wm.Rebalance(1, wm.pool.Load().workers[1]))
+		close(release)
+		assert.Eventually(t, func() bool { return wm.pool.Load().workers[0].Pending() == 0 }, time.Second, time.Millisecond)
+	}
+	// custom balancer
+	custom := RegisterLoadBalance("first", func(workers []Worker, weights []int) Balancer {
+		return &hashLB{pools: workers, slots: []int{0}}
+	})
+	lb, _ = parseLoadBalance("first")
+	assert.Equal(t, custom, lb)
+	wm = NewWorkerManager(3, lb).(*defaultWorkerManager)
+	assert.Equal(t, wm.pool.Load().workers[0], wm.Pick(2))
+	assert.Equal(t, wm.pool.Load().workers[2], wm.Rebalance(2, wm.pool.Load().workers[2]))
+}
+
+func TestWorkerQueueLimit(t *testing.T) {
+	wm := NewWorkerManager(1, RoundRobin)
+	wm.SetQueueLimit(2, OverflowDrop)
+	w := wm.Pick(0)
+	release := make(chan struct{})
+	assert.Nil(t, w.TryRun(context.Background(), func() { <-release }))
+	assert.Nil(t, w.TryRun(context.Background(), func() { <-release }))
+	assert.ErrorIs(t, w.TryRun(context.Background(), func() {}), ErrWorkerQueueFull)
+	// overflow of channel dropped
+	dc := &defaultChannel{ctx: context.Background(), worker: w, workers: wm}
+	assert.Nil(t, dc.runMessage(&message.ProtocolMessage{Route: 1}, func() { t.Error("dropped message run") }))
+	assert.Zero(t, atomic.LoadInt32(&dc.inflight))
+	close(release)
+	assert.Eventually(t, func() bool { return w.Pending() == 0 }, time.Second, time.Millisecond)
+	ms := wm.Metrics()
+	assert.Len(t, ms, 1)
+	assert.Equal(t, int64(2), ms[0].Executed)
+	assert.Equal(t, int64(2), ms[0].Rejected)
+	assert.Equal(t, OverflowDrop, wm.Overflow())
+}
+
+func TestWorkerResize(t *testing.T) {
+	wm := NewWorkerManager(2, RoundRobin)
+	wm.SetQueueLimit(8, OverflowReject)
+	workers := wm.(*defaultWorkerManager).pool.Load().workers
+	first, second := workers[0], workers[1]
+	dc := &defaultChannel{ctx: context.Background(), worker: second, workers: wm}
+	release := make(chan struct{})
+	dc.LaterRun(func() { <-release })
+	wm.Resize(1, LeastPending)
+	assert.Equal(t, []string{"smart-worker-0"}, workerNames(wm))
+	assert.Equal(t, first, wm.Pick(0))
+	assert.Equal(t, 1, wm.Pending()) // task queued on retired worker is counted
+	// channel keeps worker until its queued task finished
+	dc.rebalance()
+	assert.Equal(t, second, dc.worker)
+	close(release)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dc.inflight) == 0 }, time.Second, time.Millisecond)
+	dc.rebalance()
+	assert.Equal(t, first, dc.worker)
+	// grow
+	wm.Resize(3, RoundRobin)
+	assert.Equal(t, []string{"smart-worker-0", "smart-worker-1", "smart-worker-2"}, workerNames(wm))
+	assert.Equal(t, first, wm.(*defaultWorkerManager).pool.Load().workers[0])
+	assert.ErrorIs(t, fillWorker(wm.Pick(0), 9), ErrWorkerQueueFull)
+}
+
+// run with -race, tasks queued by other goroutines while channel moves between workers
+func TestChannelRebalanceRace(t *testing.T) {
+	wm := NewWorkerManager(2, RoundRobin)
+	dc := &defaultChannel{ctx: context.Background(), worker: wm.Pick(1), workers: wm}
+	var running, overlapped, count int32
+	task := func() {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			atomic.AddInt32(&overlapped, 1)
+			return
+		}
+		atomic.AddInt32(&count, 1)
+		atomic.StoreInt32(&running, 0)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				dc.LaterRun(task)
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		wm.Resize(1+i%2, RoundRobin)
+		dc.rebalance()
+	}
+	wg.Wait()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&count)+atomic.LoadInt32(&overlapped) == 800 }, time.Second, time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&overlapped))
+}
+
+func workerNames(wm WorkerManager) []string {
+	var names []string
+	for _, m := range wm.Metrics() {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// fillWorker queue n tasks blocked for a moment
+func fillWorker(w Worker, n int) error {
+	for i := 0; i < n; i++ {
+		if err := w.TryRun(context.Background(), func() { time.Sleep(10 * time.Millisecond) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}